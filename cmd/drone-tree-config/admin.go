@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxWebhookSize limits the size of webhook payloads which are read
+const maxWebhookSize = 25 << 20
+
+// cachePurger is implemented by the plugin
+type cachePurger interface {
+	PurgeCache(ctx context.Context, slug string, ref string, sha string) (int, error)
+}
+
+// purgeHandler removes cache entries by the slug, ref and sha query parameters. Requests have to send the token as
+// bearer token.
+func purgeHandler(purger cachePurger, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		bearer := strings.TrimPrefix(authorization, "Bearer ")
+		if bearer == authorization || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		query := r.URL.Query()
+		purged, err := purger.PurgeCache(r.Context(), query.Get("slug"), query.Get("ref"), query.Get("sha"))
+		if err != nil {
+			logrus.Warnf("unable to purge cache: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Purged int `json:"purged"`
+		}{purged})
+	}
+}
+
+// pushEvent holds the fields of github and gitlab push events which are required to purge the cache
+type pushEvent struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+// webhookHandler purges the cache entries of repos which received a push. Github requests are verified by their
+// sha256 signature, gitlab requests by their token. Other events are acknowledged and ignored.
+func webhookHandler(purger cachePurger, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+		if err != nil {
+			http.Error(w, "unable to read body", http.StatusBadRequest)
+			return
+		}
+
+		var push bool
+		switch {
+		case r.Header.Get("X-GitHub-Event") != "":
+			if !validGithubSignature(r.Header.Get("X-Hub-Signature-256"), body, secret) {
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			}
+			push = r.Header.Get("X-GitHub-Event") == "push"
+		case r.Header.Get("X-Gitlab-Event") != "":
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			event := r.Header.Get("X-Gitlab-Event")
+			push = event == "Push Hook" || event == "Tag Push Hook"
+		default:
+			http.Error(w, "unsupported webhook", http.StatusBadRequest)
+			return
+		}
+		if !push {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var event pushEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		slug := event.Repository.FullName
+		if event.Project.PathWithNamespace != "" {
+			slug = event.Project.PathWithNamespace
+		}
+		if slug == "" {
+			http.Error(w, "missing repository", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := purger.PurgeCache(r.Context(), slug, "", ""); err != nil {
+			logrus.Warnf("unable to purge cache for %s: %s", slug, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validGithubSignature checks the X-Hub-Signature-256 header of a github webhook
+func validGithubSignature(signature string, body []byte, secret string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
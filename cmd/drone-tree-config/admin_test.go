@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordingPurger counts the purges and records the slug of the last one
+type recordingPurger struct {
+	calls int
+	slug  string
+}
+
+func (p *recordingPurger) PurgeCache(ctx context.Context, slug string, ref string, sha string) (int, error) {
+	p.calls++
+	p.slug = slug
+	return 1, nil
+}
+
+func TestPurgeHandler(t *testing.T) {
+	for name, tc := range map[string]struct {
+		authorization string
+		code          int
+	}{
+		"Valid":         {authorization: "Bearer secret-token", code: http.StatusOK},
+		"WithoutScheme": {authorization: "secret-token", code: http.StatusUnauthorized},
+		"WrongToken":    {authorization: "Bearer other-token", code: http.StatusUnauthorized},
+		"Missing":       {code: http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			purger := &recordingPurger{}
+			req := httptest.NewRequest(http.MethodPost, "/admin/cache/purge?slug=foosinn/dronetest", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			purgeHandler(purger, "secret-token")(w, req)
+
+			if want, got := tc.code, w.Code; want != got {
+				t.Errorf("Want status %d got %d", want, got)
+			}
+			wantCalls := 0
+			if tc.code == http.StatusOK {
+				wantCalls = 1
+			}
+			if want, got := wantCalls, purger.calls; want != got {
+				t.Errorf("Want %d purges got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	const secret = "webhook-secret"
+	const githubPush = `{"ref": "refs/heads/master", "repository": {"full_name": "foosinn/dronetest"}}`
+	const gitlabPush = `{"ref": "refs/heads/master", "project": {"path_with_namespace": "foosinn/dronetest"}}`
+
+	sign := func(body string, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = mac.Write([]byte(body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   string
+		code   int
+		purged bool
+	}{
+		"GithubValid": {
+			header: http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {sign(githubPush, secret)}},
+			body:   githubPush, code: http.StatusNoContent, purged: true,
+		},
+		"GithubWrongSignature": {
+			header: http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {sign(githubPush, "other-secret")}},
+			body:   githubPush, code: http.StatusUnauthorized,
+		},
+		"GithubMissingSignature": {
+			header: http.Header{"X-Github-Event": {"push"}},
+			body:   githubPush, code: http.StatusUnauthorized,
+		},
+		"GithubOtherEvent": {
+			header: http.Header{"X-Github-Event": {"issues"}, "X-Hub-Signature-256": {sign(githubPush, secret)}},
+			body:   githubPush, code: http.StatusNoContent,
+		},
+		"GitlabValid": {
+			header: http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {secret}},
+			body:   gitlabPush, code: http.StatusNoContent, purged: true,
+		},
+		"GitlabWrongToken": {
+			header: http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"other-secret"}},
+			body:   gitlabPush, code: http.StatusUnauthorized,
+		},
+		"GitlabMissingToken": {
+			header: http.Header{"X-Gitlab-Event": {"Push Hook"}},
+			body:   gitlabPush, code: http.StatusUnauthorized,
+		},
+		"Unsupported": {
+			body: githubPush, code: http.StatusBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			purger := &recordingPurger{}
+			req := httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader(tc.body))
+			for name, values := range tc.header {
+				req.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			webhookHandler(purger, secret)(w, req)
+
+			if want, got := tc.code, w.Code; want != got {
+				t.Errorf("Want status %d got %d", want, got)
+			}
+			if want, got := tc.purged, purger.calls == 1; want != got {
+				t.Errorf("Want purged %v got %v", want, got)
+			}
+			if tc.purged && purger.slug != "foosinn/dronetest" {
+				t.Errorf("Want purge of foosinn/dronetest got %q", purger.slug)
+			}
+		})
+	}
+}
@@ -1,39 +1,98 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/bitsbeats/drone-tree-config/plugin"
 
-	"github.com/drone/drone-go/plugin/config"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
 type (
 	spec struct {
-		AllowListFile       string        `envconfig:"PLUGIN_ALLOW_LIST_FILE"`
-		Concat              bool          `envconfig:"PLUGIN_CONCAT"`
-		MaxDepth            int           `envconfig:"PLUGIN_MAXDEPTH" default:"2"`
-		AlwaysRunAll        bool          `envconfig:"PLUGIN_ALWAYS_RUN_ALL"`
-		Fallback            bool          `envconfig:"PLUGIN_FALLBACK"`
-		Finalize            bool          `envconfig:"PLUGIN_FINALIZE"`
-		Debug               bool          `envconfig:"PLUGIN_DEBUG"`
-		Address             string        `envconfig:"PLUGIN_ADDRESS" default:":3000"`
-		Secret              string        `envconfig:"PLUGIN_SECRET"`
-		Server              string        `envconfig:"SERVER" default:"https://api.github.com"`
-		GitHubToken         string        `envconfig:"GITHUB_TOKEN"`
-		GitLabToken         string        `envconfig:"GITLAB_TOKEN"`
-		GitLabServer        string        `envconfig:"GITLAB_SERVER" default:"https://gitlab.com"`
-		BitBucketAuthServer string        `envconfig:"BITBUCKET_AUTH_SERVER"`
-		BitBucketClient     string        `envconfig:"BITBUCKET_CLIENT"`
-		BitBucketSecret     string        `envconfig:"BITBUCKET_SECRET"`
-		ConsiderFile        string        `envconfig:"PLUGIN_CONSIDER_FILE"`
-		CacheTTL            time.Duration `envconfig:"PLUGIN_CACHE_TTL"`
+		AllowListFile       string            `envconfig:"PLUGIN_ALLOW_LIST_FILE"`
+		Concat              bool              `envconfig:"PLUGIN_CONCAT"`
+		MaxDepth            int               `envconfig:"PLUGIN_MAXDEPTH" default:"2"`
+		AlwaysRunAll        bool              `envconfig:"PLUGIN_ALWAYS_RUN_ALL"`
+		Fallback            bool              `envconfig:"PLUGIN_FALLBACK"`
+		FailOnFetchError    bool              `envconfig:"PLUGIN_FAIL_ON_FETCH_ERROR"`
+		MergeBase           bool              `envconfig:"PLUGIN_MERGE_BASE"`
+		EventStrategies     map[string]string `envconfig:"PLUGIN_EVENT_STRATEGIES"`
+		TagPattern          string            `envconfig:"PLUGIN_TAG_PATTERN"`
+		Finalize            bool              `envconfig:"PLUGIN_FINALIZE"`
+		Debug               bool              `envconfig:"PLUGIN_DEBUG"`
+		LogFormat           string            `envconfig:"PLUGIN_LOG_FORMAT" default:"text"`
+		Address             string            `envconfig:"PLUGIN_ADDRESS" default:":3000"`
+		ReadTimeout         time.Duration     `envconfig:"PLUGIN_READ_TIMEOUT" default:"10s"`
+		WriteTimeout        time.Duration     `envconfig:"PLUGIN_WRITE_TIMEOUT" default:"60s"`
+		IdleTimeout         time.Duration     `envconfig:"PLUGIN_IDLE_TIMEOUT" default:"120s"`
+		Concurrency         int               `envconfig:"PLUGIN_CONCURRENCY" default:"8"`
+		RequestTimeout      time.Duration     `envconfig:"PLUGIN_REQUEST_TIMEOUT" default:"50s"`
+		ShutdownTimeout     time.Duration     `envconfig:"PLUGIN_SHUTDOWN_TIMEOUT" default:"30s"`
+		TLSCert             string            `envconfig:"PLUGIN_TLS_CERT"`
+		TLSKey              string            `envconfig:"PLUGIN_TLS_KEY"`
+		TLSClientCA         string            `envconfig:"PLUGIN_TLS_CLIENT_CA"`
+		Secret              string            `envconfig:"PLUGIN_SECRET"`
+		Secrets             []string          `envconfig:"PLUGIN_SECRETS"`
+		SecretsFile         string            `envconfig:"PLUGIN_SECRETS_FILE"`
+		Server              string            `envconfig:"SERVER" default:"https://api.github.com"`
+		GitHubToken         string            `envconfig:"GITHUB_TOKEN"`
+		GitLabToken         string            `envconfig:"GITLAB_TOKEN"`
+		GitLabServer        string            `envconfig:"GITLAB_SERVER" default:"https://gitlab.com"`
+		BitBucketAuthServer string            `envconfig:"BITBUCKET_AUTH_SERVER"`
+		BitBucketClient     string            `envconfig:"BITBUCKET_CLIENT"`
+		BitBucketSecret     string            `envconfig:"BITBUCKET_SECRET"`
+		ConsiderFile        string            `envconfig:"PLUGIN_CONSIDER_FILE"`
+		CacheTTL            time.Duration     `envconfig:"PLUGIN_CACHE_TTL"`
+		CacheErrorTTL       time.Duration     `envconfig:"PLUGIN_CACHE_ERROR_TTL"`
+		CacheMaxEntries     int               `envconfig:"PLUGIN_CACHE_MAX_ENTRIES" default:"1000"`
+		CacheMaxBytes       int64             `envconfig:"PLUGIN_CACHE_MAX_BYTES" default:"67108864"`
+		CacheDir            string            `envconfig:"PLUGIN_CACHE_DIR"`
+		CacheRedisURL       string            `envconfig:"PLUGIN_CACHE_REDIS_URL"`
+		ScmCacheMaxBytes    int64             `envconfig:"PLUGIN_SCM_CACHE_MAX_BYTES"`
+		ScmCacheNotFoundTTL time.Duration     `envconfig:"PLUGIN_SCM_CACHE_NOT_FOUND_TTL" default:"1h"`
+		TracingExporter     string            `envconfig:"PLUGIN_TRACING_EXPORTER"`
+		AdminToken          string            `envconfig:"PLUGIN_ADMIN_TOKEN"`
+		WebhookSecret       string            `envconfig:"PLUGIN_WEBHOOK_SECRET"`
 	}
 )
 
+// pluginHandler is implemented by the plugin for the operational endpoints
+type pluginHandler interface {
+	readinessChecker
+	cachePurger
+}
+
+// newMux routes the config requests and the operational endpoints. When client certificates are verified, they are
+// only required for config requests, so probes, metric scrapes and webhooks work without one.
+func newMux(configHandler http.Handler, p pluginHandler, spec *spec) *http.ServeMux {
+	mux := http.NewServeMux()
+	if spec.TLSClientCA != "" {
+		configHandler = requireClientCert(configHandler)
+	}
+	mux.Handle("/", configHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(p))
+	mux.HandleFunc("/version", versionHandler)
+	if spec.AdminToken != "" {
+		mux.Handle("/admin/cache/purge", purgeHandler(p, spec.AdminToken))
+	}
+	if spec.WebhookSecret != "" {
+		mux.Handle("/hooks", webhookHandler(p, spec.WebhookSecret))
+	}
+	return mux
+}
+
 func main() {
 	spec := new(spec)
 	if err := envconfig.Process("", spec); err != nil {
@@ -43,7 +102,14 @@ func main() {
 	if spec.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	if spec.Secret == "" {
+	switch spec.LogFormat {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	case "text", "":
+	default:
+		logrus.Fatalf("unknown log format %q", spec.LogFormat)
+	}
+	if spec.Secret == "" && len(spec.Secrets) == 0 && spec.SecretsFile == "" {
 		logrus.Fatalln("missing secret key")
 	}
 	if spec.GitHubToken == "" && spec.GitLabToken == "" && (spec.BitBucketClient == "" || spec.BitBucketSecret == "") {
@@ -55,30 +121,115 @@ func main() {
 	if spec.BitBucketAuthServer == "" {
 		spec.BitBucketAuthServer = spec.Server
 	}
+	if (spec.TLSCert == "") != (spec.TLSKey == "") {
+		logrus.Fatalln("both a tls certificate and key are required")
+	}
+	if spec.TLSClientCA != "" && spec.TLSCert == "" {
+		logrus.Fatalln("client certificate verification requires a tls certificate and key")
+	}
 
-	handler := config.Handler(
-		plugin.New(
-			plugin.WithConcat(spec.Concat),
-			plugin.WithFallback(spec.Fallback),
-			plugin.WithAlwaysRunAll(spec.AlwaysRunAll),
-			plugin.WithMaxDepth(spec.MaxDepth),
-			plugin.WithServer(spec.Server),
-			plugin.WithAllowListFile(spec.AllowListFile),
-			plugin.WithBitBucketAuthServer(spec.BitBucketAuthServer),
-			plugin.WithBitBucketClient(spec.BitBucketClient),
-			plugin.WithBitBucketSecret(spec.BitBucketSecret),
-			plugin.WithGithubToken(spec.GitHubToken),
-			plugin.WithGitlabToken(spec.GitLabToken),
-			plugin.WithGitlabServer(spec.GitLabServer),
-			plugin.WithConsiderFile(spec.ConsiderFile),
-			plugin.WithCacheTTL(spec.CacheTTL),
-		),
-		spec.Secret,
-		logrus.StandardLogger(),
+	shutdownTracing, err := setupTracing(context.Background(), spec.TracingExporter)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logrus.Errorf("unable to shutdown tracing: %s", err)
+		}
+	}()
+
+	var cacheRedis *redis.Options
+	if spec.CacheRedisURL != "" {
+		if cacheRedis, err = redis.ParseURL(spec.CacheRedisURL); err != nil {
+			logrus.Fatalf("invalid redis url: %s", err)
+		}
+	}
+
+	eventStrategies, err := plugin.ParseEventStrategies(spec.EventStrategies)
+	if err != nil {
+		logrus.Fatalf("invalid event strategies: %s", err)
+	}
+	if spec.TagPattern == "" {
+		spec.TagPattern = plugin.DefaultTagPattern
+	}
+	tagPattern, err := plugin.ParseTagPattern(spec.TagPattern)
+	if err != nil {
+		logrus.Fatalf("invalid tag pattern: %s", err)
+	}
+
+	p := plugin.New(
+		plugin.WithConcat(spec.Concat),
+		plugin.WithFallback(spec.Fallback),
+		plugin.WithFailOnFetchError(spec.FailOnFetchError),
+		plugin.WithAlwaysRunAll(spec.AlwaysRunAll),
+		plugin.WithMergeBase(spec.MergeBase),
+		plugin.WithEventStrategies(eventStrategies),
+		plugin.WithTagPattern(tagPattern),
+		plugin.WithMaxDepth(spec.MaxDepth),
+		plugin.WithServer(spec.Server),
+		plugin.WithAllowListFile(spec.AllowListFile),
+		plugin.WithBitBucketAuthServer(spec.BitBucketAuthServer),
+		plugin.WithBitBucketClient(spec.BitBucketClient),
+		plugin.WithBitBucketSecret(spec.BitBucketSecret),
+		plugin.WithGithubToken(spec.GitHubToken),
+		plugin.WithGitlabToken(spec.GitLabToken),
+		plugin.WithGitlabServer(spec.GitLabServer),
+		plugin.WithConsiderFile(spec.ConsiderFile),
+		plugin.WithCacheTTL(spec.CacheTTL),
+		plugin.WithCacheErrorTTL(spec.CacheErrorTTL),
+		plugin.WithCacheMaxEntries(spec.CacheMaxEntries),
+		plugin.WithCacheMaxBytes(spec.CacheMaxBytes),
+		plugin.WithCacheDir(spec.CacheDir),
+		plugin.WithCacheRedis(cacheRedis),
+		plugin.WithScmCacheMaxBytes(spec.ScmCacheMaxBytes),
+		plugin.WithScmCacheNotFoundTTL(spec.ScmCacheNotFoundTTL),
+		plugin.WithRequestTimeout(spec.RequestTimeout),
+		plugin.WithConcurrency(spec.Concurrency),
 	)
+	handler, err := newSecretsHandler(p, append([]string{spec.Secret}, spec.Secrets...), spec.SecretsFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
-	logrus.Infof("server listening on address %s", spec.Address)
+	server := &http.Server{
+		Handler:      newMux(handler, p, spec),
+		Addr:         spec.Address,
+		ReadTimeout:  spec.ReadTimeout,
+		WriteTimeout: spec.WriteTimeout,
+		IdleTimeout:  spec.IdleTimeout,
+	}
+
+	if spec.TLSCert != "" {
+		tlsConfig, err := newTLSConfig(spec.TLSCert, spec.TLSKey, spec.TLSClientCA)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		server.TLSConfig = tlsConfig
+	}
 
-	http.Handle("/", handler)
-	logrus.Fatal(http.ListenAndServe(spec.Address, nil))
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			logrus.Infof("server version %s listening on address %s (tls)", version, spec.Address)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			logrus.Infof("server version %s listening on address %s", version, spec.Address)
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatal(err)
+		}
+	}()
+
+	// drain in-flight requests on shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	logrus.Infof("received %s, shutting down with a deadline of %s", sig, spec.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), spec.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Errorf("unable to shutdown gracefully: %s", err)
+	}
 }
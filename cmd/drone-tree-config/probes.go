@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
+
+const readyTimeout = 10 * time.Second
+
+// readinessChecker is implemented by the plugin
+type readinessChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// healthzHandler reports that the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether the plugin is able to serve config requests
+func readyzHandler(checker readinessChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/plain")
+		if err := checker.Ready(ctx); err != nil {
+			logrus.Warnf("readiness check failed: %s", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
+
+// versionHandler reports the version and vcs revision of the running build
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := struct {
+		Version  string `json:"version"`
+		Revision string `json:"revision,omitempty"`
+		Modified bool   `json:"modified,omitempty"`
+		Go       string `json:"go"`
+	}{
+		Version: version,
+		Go:      runtime.Version(),
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/httpsignatures-go"
+	"github.com/drone/drone-go/plugin/config"
+	"github.com/sirupsen/logrus"
+)
+
+// secretsHandler accepts config requests which are signed with any of the accepted secrets. This allows rotating
+// the secret shared with drone without downtime. The secrets are the static ones plus the ones listed in the
+// secretsFile, which is re-read when it changes.
+type secretsHandler struct {
+	plugin      config.Plugin
+	static      []string
+	secretsFile string
+
+	lock        sync.RWMutex
+	fileSecrets []string
+	fileMod     time.Time
+}
+
+func newSecretsHandler(plugin config.Plugin, static []string, secretsFile string) (*secretsHandler, error) {
+	h := &secretsHandler{
+		plugin:      plugin,
+		secretsFile: secretsFile,
+	}
+	for _, secret := range static {
+		if secret != "" {
+			h.static = append(h.static, secret)
+		}
+	}
+	if secretsFile != "" {
+		if err := h.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// reload reads the secretsFile, when its modification time changed. Each line is a secret, empty lines and lines
+// starting with "#" are ignored.
+func (h *secretsHandler) reload() error {
+	info, err := os.Stat(h.secretsFile)
+	if err != nil {
+		return err
+	}
+
+	h.lock.RLock()
+	unchanged := info.ModTime().Equal(h.fileMod)
+	h.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(h.secretsFile)
+	if err != nil {
+		return err
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secrets = append(secrets, line)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fileSecrets = secrets
+	h.fileMod = info.ModTime()
+	logrus.Infof("loaded %d secrets from %s", len(secrets), h.secretsFile)
+	return nil
+}
+
+// secrets returns all accepted secrets. On reload errors the previously loaded secrets are kept.
+func (h *secretsHandler) secrets() []string {
+	if h.secretsFile != "" {
+		if err := h.reload(); err != nil {
+			logrus.Errorf("unable to reload secrets file %s: %s", h.secretsFile, err)
+		}
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	secrets := make([]string, 0, len(h.static)+len(h.fileSecrets))
+	secrets = append(secrets, h.static...)
+	return append(secrets, h.fileSecrets...)
+}
+
+func (h *secretsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	signature, err := httpsignatures.FromRequest(r)
+	if err != nil {
+		logrus.Debugf("config: invalid or missing signature in http.Request")
+		http.Error(w, "Invalid or Missing Signature", http.StatusBadRequest)
+		return
+	}
+
+	for _, secret := range h.secrets() {
+		if signature.IsValid(secret, r) {
+			config.Handler(h.plugin, secret, logrus.StandardLogger()).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	logrus.Debugf("config: invalid signature in http.Request")
+	http.Error(w, "Invalid Signature", http.StatusBadRequest)
+}
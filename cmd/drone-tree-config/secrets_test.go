@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/drone/drone-go/plugin/config"
+)
+
+// staticPlugin returns the same config for all requests
+type staticPlugin struct{}
+
+func (staticPlugin) Find(ctx context.Context, req *config.Request) (*drone.Config, error) {
+	return &drone.Config{Data: "kind: pipeline\nname: default\n"}, nil
+}
+
+func TestSecretsHandler(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "secrets")
+	writeSecrets := func(content string, mod time.Time) {
+		t.Helper()
+		if err := ioutil.WriteFile(secretsFile, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(secretsFile, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSecrets("# rotated secrets\nfile-secret\n\n", time.Now().Add(-time.Minute))
+
+	handler, err := newSecretsHandler(staticPlugin{}, []string{"secret", "", "next-secret"}, secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	accepted := func(secret string) bool {
+		t.Helper()
+		req := &config.Request{Repo: drone.Repo{Slug: "foosinn/dronetest"}}
+		droneConfig, err := config.Client(server.URL, secret, false).Find(context.Background(), req)
+		return err == nil && droneConfig != nil && droneConfig.Data != ""
+	}
+
+	// requests signed with any configured secret are accepted
+	for secret, want := range map[string]bool{
+		"secret":      true,
+		"next-secret": true,
+		"file-secret": true,
+		"other":       false,
+	} {
+		if got := accepted(secret); want != got {
+			t.Errorf("Want %q accepted %v got %v", secret, want, got)
+		}
+	}
+
+	// the rewritten secrets file takes effect with the next request
+	writeSecrets("rotated-secret\n", time.Now())
+	for secret, want := range map[string]bool{
+		"secret":         true,
+		"rotated-secret": true,
+		"file-secret":    false,
+	} {
+		if got := accepted(secret); want != got {
+			t.Errorf("Want %q accepted %v after rewrite got %v", secret, want, got)
+		}
+	}
+}
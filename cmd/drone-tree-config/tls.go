@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certReloader serves the certificate from certFile and keyFile and reloads it when either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair when the modification time of either file changed. It returns true if a new
+// certificate was loaded.
+func (r *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	unchanged := r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod)
+	r.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return true, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. On reload errors the previous certificate is served.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if reloaded, err := r.reload(); err != nil {
+		logrus.Errorf("unable to reload tls certificate %s: %s", r.certFile, err)
+	} else if reloaded {
+		logrus.Infof("reloaded tls certificate %s", r.certFile)
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// newTLSConfig creates the tls config for the listener. When a clientCAFile is provided, client certificates have to
+// be signed by one of its CAs. Clients without a certificate are still accepted by the listener, handlers which
+// require one are wrapped with requireClientCert.
+func newTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		buf, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// requireClientCert refuses requests without a client certificate verified by the listener
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
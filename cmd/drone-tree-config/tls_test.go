@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by a test CA or itself
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate for 127.0.0.1 with the serial. It is signed by parent, or by itself if parent is
+// nil.
+func newTestCert(t *testing.T, serial int64, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "drone-tree-config"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestCert writes the certificate and key to the files and sets their modification time
+func writeTestCert(t *testing.T, c *testCert, certFile string, keyFile string, mod time.Time) {
+	t.Helper()
+	for file, data := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// noContent answers all requests with 204
+var noContent = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+})
+
+// readyPlugin is always ready and records the purges
+type readyPlugin struct {
+	recordingPurger
+}
+
+func (*readyPlugin) Ready(ctx context.Context) error {
+	return nil
+}
+
+// newTLSServer starts a server with the tls config. StartTLS is not used, as it adds its own certificate to the
+// config.
+func newTLSServer(tlsConfig *tls.Config, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = tls.NewListener(server.Listener, tlsConfig)
+	server.Start()
+	server.URL = strings.Replace(server.URL, "http://", "https://", 1)
+	return server
+}
+
+func TestTLSConfig_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := newTestCert(t, 1, true, nil)
+	writeTestCert(t, newTestCert(t, 2, false, ca), certFile, keyFile, time.Now().Add(-time.Minute))
+
+	tlsConfig, err := newTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(tlsConfig, noContent)
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	served := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if want, got := int64(2), served(); want != got {
+		t.Errorf("Want certificate %d got %d", want, got)
+	}
+
+	// the rotated files are served by the next connection
+	writeTestCert(t, newTestCert(t, 3, false, ca), certFile, keyFile, time.Now())
+	if want, got := int64(3), served(); want != got {
+		t.Errorf("Want rotated certificate %d got %d", want, got)
+	}
+
+	// an invalid file keeps the previous certificate
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(3), served(); want != got {
+		t.Errorf("Want previous certificate %d got %d", want, got)
+	}
+}
+
+func TestTLSConfig_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := newTestCert(t, 1, true, nil)
+	writeTestCert(t, newTestCert(t, 2, false, ca), certFile, keyFile, time.Now())
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTLSServer(tlsConfig, newMux(noContent, &readyPlugin{}, &spec{TLSClientCA: caFile}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	otherCA := newTestCert(t, 10, true, nil)
+	for name, tc := range map[string]struct {
+		client  *testCert
+		path    string
+		code    int
+		refused bool
+	}{
+		"SignedByCA":           {client: newTestCert(t, 4, false, ca), path: "/", code: http.StatusNoContent},
+		"WithoutCert":          {path: "/", code: http.StatusForbidden},
+		"SignedByOther":        {client: newTestCert(t, 11, false, otherCA), path: "/", refused: true},
+		"HealthzWithoutCert":   {path: "/healthz", code: http.StatusOK},
+		"ReadyzWithoutCert":    {path: "/readyz", code: http.StatusOK},
+		"MetricsWithoutCert":   {path: "/metrics", code: http.StatusOK},
+		"HealthzSignedByOther": {client: newTestCert(t, 12, false, otherCA), path: "/healthz", refused: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			clientConfig := &tls.Config{RootCAs: roots}
+			if tc.client != nil {
+				cert, err := tls.X509KeyPair(tc.client.certPEM, tc.client.keyPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.Certificates = []tls.Certificate{cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			resp, err := client.Get(server.URL + tc.path)
+			if tc.refused {
+				if err == nil {
+					resp.Body.Close()
+					t.Error("Want refused handshake")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if want, got := tc.code, resp.StatusCode; want != got {
+				t.Errorf("Want status %d got %d", want, got)
+			}
+		})
+	}
+}
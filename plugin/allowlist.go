@@ -1,38 +1,78 @@
 package plugin
 
 import (
-	"fmt"
+	"context"
 	"io/ioutil"
 	"regexp"
 	"strings"
-
-	"github.com/sirupsen/logrus"
 )
 
 // allowlisted determines if the plugin is enabled for the repo slug. decisions are made
 // by considering the regex patterns in the regexFile.
 //
 // returns true (match) or false (no match). false means the repo slug should be bypassed
-func (p *Plugin) allowlisted(req *request) bool {
+func (p *Plugin) allowlisted(ctx context.Context, req *request) bool {
+	_, span := tracer.Start(ctx, "allowlisted")
+	defer span.End()
+
 	slug := req.Repo.Slug
-	noMatchMsg := fmt.Sprintf("%s NOT allowlisted for: %s", req.UUID, slug)
-	matchMsg := fmt.Sprintf("%s allowlisted for: %s", req.UUID, slug)
+	const noMatchMsg = "NOT allowlisted"
+	const matchMsg = "allowlisted"
 
 	// requires a regex file
 	if p.allowListFile == "" {
 		// match
-		logrus.Info(matchMsg)
+		req.Log.Info(matchMsg)
 		return true
 	}
 
 	buf, err := ioutil.ReadFile(p.allowListFile)
 	if err != nil {
 		// match
-		logrus.Warnf("%s regex file read error: %s", req.UUID, err)
-		logrus.Info(matchMsg)
+		req.Log.Warnf("regex file read error: %s", err)
+		req.Log.Info(matchMsg)
 		return true
 	}
 
+	patterns, errs := compileAllowList(buf)
+	for _, err := range errs {
+		// emit a warning and consider the rest of the lines
+		req.Log.Warn(err)
+	}
+
+	for _, r := range patterns {
+		// the repo is enabled for the plugin, when there is a regex match
+		if r.MatchString(slug) {
+			// match
+			req.Log.Info(matchMsg)
+			return true
+		}
+	}
+
+	// no match
+	req.Log.Info(noMatchMsg)
+	return false
+}
+
+// verifyAllowList makes sure the allowListFile, if configured, can be read and contains only valid regex patterns
+func (p *Plugin) verifyAllowList() error {
+	if p.allowListFile == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(p.allowListFile)
+	if err != nil {
+		return err
+	}
+	if _, errs := compileAllowList(buf); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// compileAllowList compiles each line of the allow list to a regex pattern. Lines which fail to compile are
+// returned as errors.
+func compileAllowList(buf []byte) (patterns []*regexp.Regexp, errs []error) {
 	lines := strings.Split(string(buf), "\n")
 
 	for _, line := range lines {
@@ -43,20 +83,11 @@ func (p *Plugin) allowlisted(req *request) bool {
 
 		r, err := regexp.Compile(line)
 		if err != nil {
-			// emit a warning and consider the rest of the lines
-			logrus.Warnf("%s %s", req.UUID, err)
+			errs = append(errs, err)
 			continue
 		}
-
-		// the repo is enabled for the plugin, when there is a regex match
-		if r.MatchString(slug) {
-			// match
-			logrus.Info(matchMsg)
-			return true
-		}
+		patterns = append(patterns, r)
 	}
 
-	// no match
-	logrus.Info(noMatchMsg)
-	return false
+	return patterns, errs
 }
@@ -1,24 +1,49 @@
 package plugin
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"sync"
+	"strings"
 	"time"
 
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients"
 	"github.com/drone/drone-go/drone"
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	msgCacheHit    = "%s config-cache found entry for %s"
+	msgCacheHit    = "config-cache found entry for %s"
 	msgCacheExpire = "config-cache expired entry for %s"
-	msgCacheAdd    = "%s config-cache added entry for %s"
+	msgCacheEvict  = "config-cache evicted entry for %s"
+	msgCacheAdd    = "config-cache added entry for %s"
+	msgCacheError  = "config-cache backend error for %s: %s"
 )
 
+// cacheJanitorInterval is the interval in which expired entries are removed from the cache
+const cacheJanitorInterval = time.Minute
+
+// cacheBackend stores the cache entries
+type cacheBackend interface {
+	// get returns the entry for the key. It returns nil without an error if there is no entry or it has expired.
+	get(ctx context.Context, key cacheKey) (*cacheEntry, error)
+	// set stores the entry until entry.expires
+	set(ctx context.Context, entry *cacheEntry) error
+	// delete removes the entry for the key. It returns true if there was an entry.
+	delete(ctx context.Context, key cacheKey) (bool, error)
+	// purge removes all entries whose key matches. If slug is not empty, only the entries of the repo are checked.
+	// It returns the number of removed entries.
+	purge(ctx context.Context, slug string, match func(cacheKey) bool) (int, error)
+	// ping checks that the backend is reachable
+	ping(ctx context.Context) error
+}
+
 // configCache is used to cache config responses on a per request basis
 type configCache struct {
-	syncMap sync.Map
+	backend cacheBackend
 }
 
 // cacheKey holds the unique key details which are associated with the config request
@@ -30,17 +55,28 @@ type cacheKey struct {
 	event   string
 	trigger string
 	author  string
+	paths   string
 }
 
-// cacheEntry holds the response and ttl for a config request
+// cacheEntry holds the response and expiry for a config request
 type cacheEntry struct {
-	config string
-	error  error
-	ttl    *time.Timer
+	key     cacheKey
+	config  string
+	error   error
+	expires time.Time
+	// incomplete is set when configs were skipped because of failed downloads, it is not stored
+	incomplete bool
+}
+
+// newConfigCache creates a configCache which stores the entries in the backend
+func newConfigCache(backend cacheBackend) *configCache {
+	return &configCache{
+		backend: backend,
+	}
 }
 
 // newCacheEntry creates a new cacheEntry using the config string and error provided. The returned struct will have a
-// nil ttl value -- it will be established when a entry is added to the cache via the add function.
+// zero expires value -- it will be established when a entry is added to the cache via the add function.
 func newCacheEntry(config string, error error) *cacheEntry {
 	entry := &cacheEntry{
 		config: config,
@@ -59,54 +95,190 @@ func newCacheKey(req *request) cacheKey {
 		event:   req.Build.Event,
 		author:  req.Build.Author,
 		trigger: req.Build.Trigger,
+		paths:   req.Build.Params[PathsParam],
 	}
 	return ck
 }
 
-// add an entry to the cache
-func (c *configCache) add(uuid uuid.UUID, key cacheKey, entry *cacheEntry, ttl time.Duration) {
-	logrus.Infof(msgCacheAdd, uuid, fmt.Sprintf("%+v", key))
+// hash returns a stable representation of the key which can be used by external backends
+func (k cacheKey) hash() string {
+	fields := []string{k.slug, k.ref, k.before, k.after, k.event, k.trigger, k.author}
+	// only added if set, so the hashes of the existing entries stay valid
+	if k.paths != "" {
+		fields = append(fields, k.paths)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
 
-	entry.ttl = time.AfterFunc(ttl, func() {
-		c.expire(key)
-	})
+// cacheRecord is the serialized representation of a cacheEntry used by external backends
+type cacheRecord struct {
+	Slug    string    `json:"slug"`
+	Ref     string    `json:"ref"`
+	Before  string    `json:"before"`
+	After   string    `json:"after"`
+	Event   string    `json:"event"`
+	Trigger string    `json:"trigger"`
+	Author  string    `json:"author"`
+	Paths   string    `json:"paths,omitempty"`
+	Config  string    `json:"config"`
+	Error   *string   `json:"error,omitempty"`
+	Expires time.Time `json:"expires"`
+}
 
-	c.syncMap.Store(key, entry)
+// encodeCacheEntry serializes the entry. Errors are stored by their message only.
+func encodeCacheEntry(entry *cacheEntry) ([]byte, error) {
+	record := cacheRecord{
+		Slug:    entry.key.slug,
+		Ref:     entry.key.ref,
+		Before:  entry.key.before,
+		After:   entry.key.after,
+		Event:   entry.key.event,
+		Trigger: entry.key.trigger,
+		Author:  entry.key.author,
+		Paths:   entry.key.paths,
+		Config:  entry.config,
+		Expires: entry.expires,
+	}
+	if entry.error != nil {
+		msg := entry.error.Error()
+		record.Error = &msg
+	}
+	return json.Marshal(record)
 }
 
-// expire is typically called internally via a time.Afterfunc
-func (c *configCache) expire(key cacheKey) {
-	logrus.Infof(msgCacheExpire, fmt.Sprintf("%+v", key))
+// decodeCacheEntry deserializes an entry created by encodeCacheEntry
+func decodeCacheEntry(data []byte) (*cacheEntry, error) {
+	var record cacheRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{
+		key: cacheKey{
+			slug:    record.Slug,
+			ref:     record.Ref,
+			before:  record.Before,
+			after:   record.After,
+			event:   record.Event,
+			trigger: record.Trigger,
+			author:  record.Author,
+			paths:   record.Paths,
+		},
+		config:  record.Config,
+		expires: record.Expires,
+	}
+	if record.Error != nil {
+		entry.error = errors.New(*record.Error)
+	}
+	return entry, nil
+}
 
-	if entry, _ := c.syncMap.Load(key); entry != nil {
-		entry.(*cacheEntry).ttl.Stop()
-		c.syncMap.Delete(key)
+// size estimates the memory used by the entry in bytes
+func (e *cacheEntry) size() int64 {
+	size := len(e.config) + len(e.key.slug) + len(e.key.ref) + len(e.key.before) + len(e.key.after) +
+		len(e.key.event) + len(e.key.trigger) + len(e.key.author) + len(e.key.paths)
+	if e.error != nil {
+		size += len(e.error.Error())
 	}
+	return int64(size)
 }
 
-// retrieve an entry from the cache, if it exists
-func (c *configCache) retrieve(uuid uuid.UUID, key cacheKey) (*cacheEntry, bool) {
-	entry, exists := c.syncMap.Load(key)
-	if exists {
-		logrus.Infof(msgCacheHit, uuid, fmt.Sprintf("%+v", key))
-		return entry.(*cacheEntry), true
+// add an entry to the cache
+func (c *configCache) add(ctx context.Context, log *logrus.Entry, key cacheKey, entry *cacheEntry, ttl time.Duration) {
+	entry.key = key
+	entry.expires = time.Now().Add(ttl)
+
+	if err := c.backend.set(ctx, entry); err != nil {
+		log.Errorf(msgCacheError, fmt.Sprintf("%+v", key), err)
+		return
 	}
+	log.Infof(msgCacheAdd, fmt.Sprintf("%+v", key))
+}
 
+// retrieve an entry from the cache, if it exists and has not expired yet
+func (c *configCache) retrieve(ctx context.Context, log *logrus.Entry, key cacheKey) (*cacheEntry, bool) {
+	entry, err := c.backend.get(ctx, key)
+	if err != nil {
+		log.Errorf(msgCacheError, fmt.Sprintf("%+v", key), err)
+	}
+	if entry != nil {
+		log.Infof(msgCacheHit, fmt.Sprintf("%+v", key))
+		cacheOperationsTotal.WithLabelValues("hit").Inc()
+		return entry, true
+	}
+
+	cacheOperationsTotal.WithLabelValues("miss").Inc()
 	return nil, false
 }
 
+// purge removes all entries matching the non-empty arguments. The sha matches the before and the after commit.
+func (c *configCache) purge(ctx context.Context, slug string, ref string, sha string) (int, error) {
+	purged, err := c.backend.purge(ctx, slug, func(key cacheKey) bool {
+		return (slug == "" || key.slug == slug) &&
+			(ref == "" || key.ref == ref) &&
+			(sha == "" || key.after == sha || key.before == sha)
+	})
+	cacheOperationsTotal.WithLabelValues("purge").Add(float64(purged))
+	return purged, err
+}
+
+// ping checks that the cache backend is reachable
+func (c *configCache) ping(ctx context.Context) error {
+	return c.backend.ping(ctx)
+}
+
+// entryTTL returns the time to live for the entry. Configs and errors which will not change, e.g. missing files or
+// invalid configs of a commit, are cached for the full TTL. All other errors use the error TTL, so they are retried
+// soon: transient and unknown errors, rejected credentials which may be fixed by a new token, truncated trees, errors
+// of requests without a commit id and configs which are incomplete because of failed downloads.
+func (p *Plugin) entryTTL(key cacheKey, entry *cacheEntry) time.Duration {
+	if entry.incomplete {
+		return p.cacheErrorTTL
+	}
+	if entry.error == nil {
+		return p.cacheTTL
+	}
+	if !scm_clients.IsCommitSHA(key.after) || errors.Is(entry.error, scm_clients.ErrTreeTruncated) {
+		return p.cacheErrorTTL
+	}
+	var cErr *configError
+	if errors.As(entry.error, &cErr) {
+		return p.cacheTTL
+	}
+	switch scm_clients.Classify(entry.error) {
+	case scm_clients.ErrorNotFound, scm_clients.ErrorPermanent:
+		return p.cacheTTL
+	}
+	return p.cacheErrorTTL
+}
+
 // cacheAndReturn caches the result (if enabled) and returns the (drone.Config, error) that should be
 // returned to the Find request.
-func (p *Plugin) cacheAndReturn(uuid uuid.UUID, key cacheKey, entry *cacheEntry) (*drone.Config, error) {
+func (p *Plugin) cacheAndReturn(ctx context.Context, log *logrus.Entry, key cacheKey, entry *cacheEntry) (*drone.Config, error) {
 	var config *drone.Config
 	if entry.config != "" {
 		config = &drone.Config{Data: entry.config}
 	}
 
 	// cache the config before we return it, if enabled
-	if p.cacheTTL > 0 {
-		p.cache.add(uuid, key, entry, p.cacheTTL)
+	if ttl := p.entryTTL(key, entry); p.cacheTTL > 0 && ttl > 0 {
+		p.cache.add(ctx, log, key, entry, ttl)
 	}
 
 	return config, entry.error
 }
+
+// PurgeCache removes the cached configs of the repo slug, ref or commit sha. At least one of them is required, all
+// non-empty ones have to match. It returns the number of removed entries.
+func (p *Plugin) PurgeCache(ctx context.Context, slug string, ref string, sha string) (int, error) {
+	if slug == "" && ref == "" && sha == "" {
+		return 0, errors.New("a slug, ref or sha is required")
+	}
+	purged, err := p.cache.purge(ctx, slug, ref, sha)
+	logrus.WithFields(logrus.Fields{
+		"slug": slug,
+		"ref":  ref,
+		"sha":  sha,
+	}).Infof("config-cache purged %d entries", purged)
+	return purged, err
+}
@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diskCache is a cacheBackend which stores each entry in a file in dir, so entries survive restarts
+type diskCache struct {
+	dir     string
+	janitor sync.Once
+}
+
+// newDiskCache creates a diskCache. The directory is created on demand.
+func newDiskCache(dir string) *diskCache {
+	return &diskCache{
+		dir: dir,
+	}
+}
+
+// path returns the file name of the entry for key
+func (c *diskCache) path(key cacheKey) string {
+	return filepath.Join(c.dir, key.hash()+".json")
+}
+
+func (c *diskCache) get(ctx context.Context, key cacheKey) (*cacheEntry, error) {
+	entry, err := c.read(c.path(key))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	// guard against hash collisions
+	if entry.key != key {
+		return nil, nil
+	}
+	if !time.Now().Before(entry.expires) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (c *diskCache) set(ctx context.Context, entry *cacheEntry) error {
+	c.janitor.Do(func() {
+		go c.runJanitor(cacheJanitorInterval)
+	})
+
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so readers never see a partial entry
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(entry.key))
+}
+
+func (c *diskCache) delete(ctx context.Context, key cacheKey) (bool, error) {
+	err := os.Remove(c.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *diskCache) purge(ctx context.Context, slug string, match func(cacheKey) bool) (int, error) {
+	files, err := ioutil.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(c.dir, f.Name())
+		entry, err := c.read(file)
+		if err != nil || entry == nil || !match(entry.key) {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// ping checks that the directory is writable
+func (c *diskCache) ping(ctx context.Context) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, ".ping-")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// read loads the entry from file. It returns nil without an error if the file does not exist.
+func (c *diskCache) read(file string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry, err := decodeCacheEntry(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %s", file, err)
+	}
+	return entry, nil
+}
+
+// expireAll removes all entries which expired before now, as well as files which can not be decoded
+func (c *diskCache) expireAll(now time.Time) {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		logrus.Errorf("config-cache unable to list %s: %s", c.dir, err)
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(c.dir, f.Name())
+		entry, err := c.read(file)
+		if err != nil {
+			logrus.Warnf("config-cache removing invalid entry: %s", err)
+			_ = os.Remove(file)
+			continue
+		}
+		if entry != nil && now.After(entry.expires) {
+			logrus.Infof(msgCacheExpire, fmt.Sprintf("%+v", entry.key))
+			_ = os.Remove(file)
+			cacheOperationsTotal.WithLabelValues("expire").Inc()
+		}
+	}
+}
+
+// runJanitor removes expired entries, including those left over from a previous run, periodically
+func (c *diskCache) runJanitor(interval time.Duration) {
+	c.expireAll(time.Now())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.expireAll(now)
+	}
+}
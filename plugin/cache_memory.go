@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// memoryCache is a cacheBackend which keeps the entries in memory. It is bounded by maxEntries and maxBytes, a
+// value of 0 disables the respective limit. When a limit is reached, the least recently used entries are evicted.
+type memoryCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	lock    sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     list.List
+	bytes   int64
+	janitor sync.Once
+}
+
+// newMemoryCache creates a memoryCache with the provided limits
+func newMemoryCache(maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func (c *memoryCache) get(ctx context.Context, key cacheKey) (*cacheEntry, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *memoryCache) set(ctx context.Context, entry *cacheEntry) error {
+	c.janitor.Do(func() {
+		go c.runJanitor(cacheJanitorInterval)
+	})
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*list.Element)
+	}
+	if element, exists := c.entries[entry.key]; exists {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+
+	// evict the least recently used entries until the limits are satisfied
+	for (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		oldest := c.lru.Back()
+		logrus.Infof(msgCacheEvict, fmt.Sprintf("%+v", oldest.Value.(*cacheEntry).key))
+		c.remove(oldest)
+		cacheOperationsTotal.WithLabelValues("evict").Inc()
+	}
+	c.updateGauges()
+	return nil
+}
+
+func (c *memoryCache) delete(ctx context.Context, key cacheKey) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exists := c.entries[key]
+	if exists {
+		c.remove(element)
+		c.updateGauges()
+	}
+	return exists, nil
+}
+
+func (c *memoryCache) purge(ctx context.Context, slug string, match func(cacheKey) bool) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	purged := 0
+	for key, element := range c.entries {
+		if match(key) {
+			c.remove(element)
+			purged++
+		}
+	}
+	c.updateGauges()
+	return purged, nil
+}
+
+// ping always succeeds for the in memory cache
+func (c *memoryCache) ping(ctx context.Context) error {
+	return nil
+}
+
+// expireAll removes all entries which expired before now
+func (c *memoryCache) expireAll(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, element := range c.entries {
+		entry := element.Value.(*cacheEntry)
+		if now.After(entry.expires) {
+			logrus.Infof(msgCacheExpire, fmt.Sprintf("%+v", entry.key))
+			c.remove(element)
+			cacheOperationsTotal.WithLabelValues("expire").Inc()
+		}
+	}
+	c.updateGauges()
+}
+
+// runJanitor periodically removes expired entries
+func (c *memoryCache) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.expireAll(now)
+	}
+}
+
+// remove deletes the element from the cache. The caller must hold the lock.
+func (c *memoryCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// updateGauges exports the current size of the cache. The caller must hold the lock.
+func (c *memoryCache) updateGauges() {
+	cacheEntries.Set(float64(c.lru.Len()))
+	cacheBytes.Set(float64(c.bytes))
+}
@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisKeyPrefix is prepended to the keys of the entries stored in redis
+	redisKeyPrefix = "drone-tree-config:config:"
+	// redisIndexPrefix is prepended to the keys of the sets which index the entries of a repo by their hash
+	redisIndexPrefix = "drone-tree-config:slug:"
+)
+
+// redisSet stores an entry and adds its hash to the index of the repo. The index expires with its latest entry.
+var redisSet = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+redis.call("SADD", KEYS[2], ARGV[3])
+if redis.call("PTTL", KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// redisCache is a cacheBackend which stores the entries in redis, so they can be shared between replicas. The entries
+// expire server side. The hashes of the entries are indexed per repo, so a repo can be purged without a scan.
+type redisCache struct {
+	client *redis.Client
+}
+
+// newRedisCache creates a redisCache connecting with the provided options
+func newRedisCache(options *redis.Options) *redisCache {
+	return &redisCache{
+		client: redis.NewClient(options),
+	}
+}
+
+// redisKey returns the redis key of the entry for key
+func redisKey(key cacheKey) string {
+	return redisKeyPrefix + key.hash()
+}
+
+// redisIndexKey returns the redis key of the index of the repo
+func redisIndexKey(slug string) string {
+	return redisIndexPrefix + slug
+}
+
+func (c *redisCache) get(ctx context.Context, key cacheKey) (*cacheEntry, error) {
+	data, err := c.client.Get(ctx, redisKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry, err := decodeCacheEntry(data)
+	if err != nil {
+		return nil, err
+	}
+	// guard against hash collisions
+	if entry.key != key {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (c *redisCache) set(ctx context.Context, entry *cacheEntry) error {
+	ttl := time.Until(entry.expires)
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := encodeCacheEntry(entry)
+	if err != nil {
+		return err
+	}
+	hash := entry.key.hash()
+	keys := []string{redisKeyPrefix + hash, redisIndexKey(entry.key.slug)}
+	return redisSet.Run(ctx, c.client, keys, data, ttl.Milliseconds(), hash).Err()
+}
+
+func (c *redisCache) delete(ctx context.Context, key cacheKey) (bool, error) {
+	deleted, err := c.client.Del(ctx, redisKey(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	return deleted > 0, c.client.SRem(ctx, redisIndexKey(key.slug), key.hash()).Err()
+}
+
+// purge checks the entries in the index of the repo. Without a slug, it scans all keys of the cache, so it should
+// only be used for administrative tasks.
+func (c *redisCache) purge(ctx context.Context, slug string, match func(cacheKey) bool) (int, error) {
+	if slug == "" {
+		return c.purgeScan(ctx, match)
+	}
+
+	index := redisIndexKey(slug)
+	hashes, err := c.client.SMembers(ctx, index).Result()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, hash := range hashes {
+		removed, exists, err := c.purgeKey(ctx, redisKeyPrefix+hash, match)
+		if err != nil {
+			return purged, err
+		}
+		if removed {
+			purged++
+		}
+		// expired entries are removed from the index as well
+		if removed || !exists {
+			if err := c.client.SRem(ctx, index, hash).Err(); err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+// purgeScan scans all keys of the cache for matching entries
+func (c *redisCache) purgeScan(ctx context.Context, match func(cacheKey) bool) (int, error) {
+	purged := 0
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		removed, _, err := c.purgeKey(ctx, iter.Val(), match)
+		if err != nil {
+			return purged, err
+		}
+		if removed {
+			purged++
+		}
+	}
+	return purged, iter.Err()
+}
+
+// purgeKey deletes the entry stored at the redis key if it matches. It returns whether the entry was removed and
+// whether it existed.
+func (c *redisCache) purgeKey(ctx context.Context, key string, match func(cacheKey) bool) (bool, bool, error) {
+	data, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	entry, err := decodeCacheEntry(data)
+	if err != nil || !match(entry.key) {
+		return false, true, nil
+	}
+	deleted, err := c.client.Del(ctx, key).Result()
+	return deleted > 0, true, err
+}
+
+func (c *redisCache) ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
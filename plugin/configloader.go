@@ -2,9 +2,13 @@ package plugin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path"
+	"sort"
 	"strings"
 
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
@@ -18,6 +22,20 @@ type LoadedDroneConfig struct {
 	Content string
 }
 
+// configError is returned for missing or invalid configs. Unlike a failed SCM request, it does not change for a
+// commit.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
 // DroneConfigCombiner holds multiple LoadedDroneConfigs to combine them
 type DroneConfigCombiner struct {
 	LoadedConfigs []*LoadedDroneConfig
@@ -97,44 +115,76 @@ func (dcc *DroneConfigCombiner) Combine(mondifyFinalizeConfig bool) string {
 	return combined
 }
 
+// droneConfigResult holds the result of getDroneConfig
+type droneConfigResult struct {
+	ldc      *LoadedDroneConfig
+	critical bool
+	err      error
+}
+
 // getConfigForChanges scans a repository for drone configs based on the changed
 // files and concats them to a single file.
 func (p *Plugin) getConfigForChanges(ctx context.Context, req *request, changedFiles []string) (dcc *DroneConfigCombiner, err error) {
-	// collect drone.yml files
-	combiner := &DroneConfigCombiner{}
-	cache := map[string]bool{}
-	for _, file := range changedFiles {
+	// collect the candidate drone.yml files of each changed file, nearest first
+	candidates := make([][]string, len(changedFiles))
+	var unique []string
+	seen := map[string]bool{}
+	for i, file := range changedFiles {
 		dir := file
 		for dir != "." {
 			dir = path.Join(dir, "..")
 			file := path.Join(dir, req.Repo.Config)
 
-			// check if file has already been checked
-			_, ok := cache[file]
-			if ok {
+			// when enabled, only process drone.yml from p.considerFile
+			if p.considerFile != "" && !req.ConsiderData.consider(file) {
 				continue
-			} else {
-				cache[file] = true
 			}
 
-			// when enabled, only process drone.yml from p.considerFile
-			if p.considerFile != "" && !req.ConsiderData.consider(file) {
+			candidates[i] = append(candidates[i], file)
+			if !seen[file] {
+				seen[file] = true
+				unique = append(unique, file)
+			}
+		}
+	}
+
+	// with concat, all candidates are used and downloaded at once. otherwise only the candidates up to the first
+	// config of each changed file are used, so they are downloaded one by one when they are reached.
+	byFile := make(map[string]*droneConfigResult, len(unique))
+	if p.concat {
+		results := p.getDroneConfigs(ctx, req, unique)
+		for i, file := range unique {
+			byFile[file] = &results[i]
+		}
+	}
+
+	// collect drone.yml files in the order of the changed files
+	combiner := &DroneConfigCombiner{}
+	cache := map[string]bool{}
+	for _, files := range candidates {
+		for _, file := range files {
+			// check if file has already been checked
+			if cache[file] {
 				continue
 			}
+			cache[file] = true
 
-			// download file from git
-			ldc, critical, err := p.getDroneConfig(ctx, req, file)
-			if err != nil {
-				if critical {
-					return nil, err
+			result, ok := byFile[file]
+			if !ok {
+				result = &droneConfigResult{}
+				result.ldc, result.critical, result.err = p.getDroneConfig(ctx, req, file)
+			}
+			if result.err != nil {
+				if result.critical {
+					return nil, result.err
 				}
 				continue
 			}
 
 			// append
-			combiner.Append(ldc)
+			combiner.Append(result.ldc)
 			if !p.concat {
-				logrus.Infof("%s concat is disabled. Using just first .drone.yml.", req.UUID)
+				req.Log.Info("concat is disabled. Using just first .drone.yml.")
 				break
 			}
 		}
@@ -142,6 +192,44 @@ func (p *Plugin) getConfigForChanges(ctx context.Context, req *request, changedF
 	return combiner, nil
 }
 
+// getConfigForDirs loads the drone configs in the directories, without scanning their parents or subdirectories. It
+// fails if none of the directories contains a config.
+func (p *Plugin) getConfigForDirs(ctx context.Context, req *request, dirs []string) (dcc *DroneConfigCombiner, err error) {
+	var files []string
+	for _, dir := range dirs {
+		file := path.Join(dir, req.Repo.Config)
+
+		// when enabled, only process drone.yml from p.considerFile
+		if p.considerFile != "" && !req.ConsiderData.consider(file) {
+			req.Log.Warnf("skipping %s, not listed in the consider file", file)
+			continue
+		}
+		files = append(files, file)
+	}
+
+	results := p.getDroneConfigs(ctx, req, files)
+
+	dcc = &DroneConfigCombiner{}
+	for i, result := range results {
+		if result.critical {
+			return nil, result.err
+		}
+		if result.err != nil {
+			req.Log.Warnf("no config in %s", path.Dir(files[i]))
+			continue
+		}
+		dcc.Append(result.ldc)
+		if !p.concat {
+			req.Log.Info("concat is disabled. Using just first .drone.yml.")
+			break
+		}
+	}
+	if len(dcc.LoadedConfigs) == 0 {
+		return nil, &configError{fmt.Errorf("did not find a %s in %q", req.Repo.Config, dirs)}
+	}
+	return dcc, nil
+}
+
 // getConfigForTree searches for all or first 'drone.yml' in the repo
 func (p *Plugin) getConfigForTree(ctx context.Context, req *request, dir string, depth int) (dcc *DroneConfigCombiner, err error) {
 	dcc = &DroneConfigCombiner{}
@@ -151,41 +239,67 @@ func (p *Plugin) getConfigForTree(ctx context.Context, req *request, dir string,
 		return p.getConfigForChanges(ctx, req, req.ConsiderData.listRepresentation)
 	}
 
-	ls, err := req.Client.GetFileListing(ctx, dir, req.Build.After)
-	if err != nil {
+	// list the whole tree at once, with concat disabled only the first entry of each directory is used
+	if p.concat && depth == 0 {
+		dcc, err = p.getConfigForFileTree(ctx, req, dir)
+		if !errors.Is(err, scm_clients.ErrTreeTruncated) {
+			return dcc, err
+		}
+		req.Log.Warn("file tree truncated, listing directories one by one")
+		dcc = &DroneConfigCombiner{}
+	}
+
+	// check recursively for drone.yml, the entries are scanned concurrently and merged in order
+	root := p.walkTree(ctx, req, &treeNode{path: dir, dir: true, depth: depth})
+	if err := root.merge(dcc); err != nil {
 		return nil, err
 	}
+	return dcc, nil
+}
 
-	if depth > p.maxDepth {
-		logrus.Infof("%s skipping scan of %s, max depth %d reached.", req.UUID, dir, depth)
-		return dcc, nil
+// getConfigForFileTree searches for all 'drone.yml' in the recursive listing of dir
+func (p *Plugin) getConfigForFileTree(ctx context.Context, req *request, dir string) (dcc *DroneConfigCombiner, err error) {
+	ls, err := req.Client.GetFileTree(ctx, dir, req.Build.After, p.maxDepth)
+	if err != nil {
+		return nil, err
 	}
-	depth += 1
 
-	// check recursively for drone.yml
+	// keep the order of a depth first scan, independent of the order returned by the provider
+	var files []string
 	for _, f := range ls {
-		if f.Type == "dir" {
-			innerDcc, err := p.getConfigForTree(ctx, req, f.Path, depth)
-			if err != nil {
-				return nil, err
-			}
-			dcc.Merge(innerDcc)
-		} else if f.Type == "file" && f.Name == req.Repo.Config {
-			ldc, critical, err := p.getDroneConfig(ctx, req, f.Path)
-			if critical {
-				return nil, err
-			}
-			dcc.Append(ldc)
-		}
-		if !p.concat {
-			logrus.Infof("%s concat is disabled. Using just first .drone.yml.", req.UUID)
-			break
+		if f.Type == "file" && f.Name == req.Repo.Config {
+			files = append(files, f.Path)
 		}
 	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return lessPath(files[i], files[j])
+	})
+
+	results := p.getDroneConfigs(ctx, req, files)
 
+	dcc = &DroneConfigCombiner{}
+	for _, result := range results {
+		if result.critical {
+			return nil, result.err
+		}
+		if result.err == nil {
+			dcc.Append(result.ldc)
+		}
+	}
 	return dcc, nil
 }
 
+// lessPath compares the paths by their elements, so all entries of a directory are sorted next to each other
+func lessPath(a string, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
 // getDroneConfig downloads a drone config and validates it
 func (p *Plugin) getDroneConfig(
 	ctx context.Context, req *request, file string,
@@ -193,8 +307,33 @@ func (p *Plugin) getDroneConfig(
 	loadedDroneConfig *LoadedDroneConfig, critical bool, err error,
 ) {
 	fileContent, err := p.getScmFile(ctx, req, file)
+	return p.parseDroneConfig(req, file, fileContent, err)
+}
+
+// getDroneConfigs downloads multiple drone configs, with a single batch if supported by the SCM, and validates them
+func (p *Plugin) getDroneConfigs(ctx context.Context, req *request, files []string) []droneConfigResult {
+	contents := p.getScmFiles(ctx, req, files)
+	results := make([]droneConfigResult, len(files))
+	for i, file := range files {
+		r := &results[i]
+		r.ldc, r.critical, r.err = p.parseDroneConfig(req, file, contents[i].Content, contents[i].Err)
+	}
+	return results
+}
+
+// parseDroneConfig validates the downloaded drone config. Files which can not be downloaded are skipped, unless
+// failOnFetchErr is enabled and the file does exist. Invalid configs are critical.
+func (p *Plugin) parseDroneConfig(req *request, file string, fileContent string, err error) (*LoadedDroneConfig, bool, error) {
 	if err != nil {
-		logrus.Debugf("%s skipping: unable to load file: %s %v", req.UUID, file, err)
+		if scm_clients.Classify(err) != scm_clients.ErrorNotFound {
+			if p.failOnFetchErr {
+				req.Log.Errorf("unable to load file: %s %v", file, err)
+				return nil, true, err
+			}
+			// the config may be incomplete, so it is only cached like an error
+			req.fetchFailed.Store(true)
+		}
+		req.Log.Debugf("skipping: unable to load file: %s %v", file, err)
 		return nil, false, err
 	}
 
@@ -202,15 +341,15 @@ func (p *Plugin) getDroneConfig(
 	dc := droneConfig{}
 	err = yaml.Unmarshal([]byte(fileContent), &dc)
 	if err != nil {
-		logrus.Errorf("%s skipping: unable to parse yml file: %s %v", req.UUID, file, err)
-		return nil, true, err
+		req.Log.Errorf("skipping: unable to parse yml file: %s %v", file, err)
+		return nil, true, &configError{err}
 	}
 	if dc.Name == "" || dc.Kind == "" {
-		logrus.Errorf("%s skipping: missing 'kind' or 'name' in %s.", req.UUID, file)
-		return nil, true, err
+		req.Log.Errorf("skipping: missing 'kind' or 'name' in %s.", file)
+		return nil, true, &configError{fmt.Errorf("missing 'kind' or 'name' in %s", file)}
 	}
 
-	logrus.Infof("%s found %s/%s %s", req.UUID, req.Repo.Namespace, req.Repo.Name, file)
+	req.Log.Infof("found %s", file)
 	return &LoadedDroneConfig{
 		Name:    dc.Name,
 		Content: fileContent,
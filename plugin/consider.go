@@ -3,8 +3,6 @@ package plugin
 import (
 	"context"
 	"strings"
-
-	"github.com/sirupsen/logrus"
 )
 
 // ConsiderData holds the considerFile information in both list and map representations
@@ -20,8 +18,11 @@ func (c *ConsiderData) consider(path string) bool {
 }
 
 // newConsiderDataFromRequest returns the ConsiderData which is loaded from the considerFile
-func (p *Plugin) newConsiderDataFromRequest(ctx context.Context, req *request) (*ConsiderData, error) {
-	cd := new(ConsiderData)
+func (p *Plugin) newConsiderDataFromRequest(ctx context.Context, req *request) (cd *ConsiderData, err error) {
+	ctx, span := tracer.Start(ctx, "newConsiderDataFromRequest")
+	defer func() { endSpan(span, err) }()
+
+	cd = new(ConsiderData)
 	cd.mapRepresentation = make(map[string]bool)
 	cd.listRepresentation = make([]string, 0)
 
@@ -33,7 +34,7 @@ func (p *Plugin) newConsiderDataFromRequest(ctx context.Context, req *request) (
 	// download considerFile from github
 	fc, err := p.getScmFile(ctx, req, p.considerFile)
 	if err != nil {
-		logrus.Errorf("%s skipping: %s is not present: %v", req.UUID, p.considerFile, err)
+		req.Log.Errorf("skipping: %s is not present: %v", p.considerFile, err)
 		return cd, err
 	}
 
@@ -45,7 +46,7 @@ func (p *Plugin) newConsiderDataFromRequest(ctx context.Context, req *request) (
 		}
 		// skip lines which do not contain a 'drone.yml' reference
 		if !strings.HasSuffix(v, req.Repo.Config) {
-			logrus.Warnf("%s skipping invalid reference to %s in %s", req.UUID, v, p.considerFile)
+			req.Log.Warnf("skipping invalid reference to %s in %s", v, p.considerFile)
 			continue
 		}
 		cd.listRepresentation = append(cd.listRepresentation, v)
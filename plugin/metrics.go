@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/drone/drone-go/drone"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	outcomeConfig = "config"
+	outcomeNil    = "nil"
+	outcomeError  = "error"
+)
+
+var (
+	findRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "find_requests_total",
+			Help:      "Number of config requests by outcome (config, nil, error).",
+		},
+		[]string{"outcome"},
+	)
+	findDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "drone_tree_config",
+			Name:      "find_duration_seconds",
+			Help:      "Latency of config requests by outcome (config, nil, error).",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"outcome"},
+	)
+	findCoalescedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "find_coalesced_total",
+			Help:      "Number of config requests which shared the result with a concurrent identical request.",
+		},
+	)
+	cacheOperationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "cache_operations_total",
+			Help:      "Number of config cache operations by result (hit, miss, evict, expire, purge).",
+		},
+		[]string{"result"},
+	)
+	cacheEntries = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "cache_entries",
+			Help:      "Number of entries in the config cache.",
+		},
+	)
+	cacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "cache_bytes",
+			Help:      "Estimated size of the entries in the config cache.",
+		},
+	)
+	configsCombined = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "drone_tree_config",
+			Name:      "configs_combined",
+			Help:      "Number of drone configs combined per request.",
+			Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64},
+		},
+	)
+)
+
+// observeFind records the outcome and latency of a Find call which was started at start
+func observeFind(start time.Time, config *drone.Config, err error) {
+	outcome := outcomeConfig
+	switch {
+	case err != nil:
+		outcome = outcomeError
+	case config == nil:
+		outcome = outcomeNil
+	}
+	findRequestsTotal.WithLabelValues(outcome).Inc()
+	findDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
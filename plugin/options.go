@@ -1,6 +1,11 @@
 package plugin
 
-import "time"
+import (
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
 
 // WithServer configures with a custom SCM server
 func WithServer(server string) func(*Plugin) {
@@ -65,6 +70,14 @@ func WithFallback(fallback bool) func(*Plugin) {
 	}
 }
 
+// WithFailOnFetchError configures whether a .drone.yml which can not be downloaded fails the request instead of
+// being skipped
+func WithFailOnFetchError(failOnFetchErr bool) func(*Plugin) {
+	return func(p *Plugin) {
+		p.failOnFetchErr = failOnFetchErr
+	}
+}
+
 // WithFinalizeSupport adds dependencies to all pipelines to a user provider pipelined named `finalize`
 func WithFinalizeSupport(finalize bool) func(*Plugin) {
 	return func(p *Plugin) {
@@ -79,6 +92,29 @@ func WithAlwaysRunAll(alwaysRunAll bool) func(*Plugin) {
 	}
 }
 
+// WithMergeBase configures new branches to be compared with the merge base of the repo's default branch instead of
+// their last commit
+func WithMergeBase(mergeBase bool) func(*Plugin) {
+	return func(p *Plugin) {
+		p.mergeBase = mergeBase
+	}
+}
+
+// WithEventStrategies configures the strategy used to select the configs per build event, events without a strategy use
+// StrategyChanges
+func WithEventStrategies(eventStrategies map[string]Strategy) func(*Plugin) {
+	return func(p *Plugin) {
+		p.eventStrategies = eventStrategies
+	}
+}
+
+// WithTagPattern configures the pattern used by StrategyTagPrefix to find the directory of a tag, see ParseTagPattern
+func WithTagPattern(tagPattern *regexp.Regexp) func(*Plugin) {
+	return func(p *Plugin) {
+		p.tagPattern = tagPattern
+	}
+}
+
 // WithMaxDepth configures with max depth to search for 'drone.yml'. Requires fallback to be enabled.
 func WithMaxDepth(maxDepth int) func(*Plugin) {
 	return func(p *Plugin) {
@@ -101,9 +137,74 @@ func WithConsiderFile(considerFile string) func(*Plugin) {
 	}
 }
 
+// WithRequestTimeout configures the deadline for handling a single config request, including all SCM calls
+func WithRequestTimeout(timeout time.Duration) func(*Plugin) {
+	return func(p *Plugin) {
+		p.requestTimeout = timeout
+	}
+}
+
+// WithConcurrency limits the number of concurrent SCM calls of a single config request
+func WithConcurrency(concurrency int) func(*Plugin) {
+	return func(p *Plugin) {
+		p.concurrency = concurrency
+	}
+}
+
 // WithCacheTTL enables request/response caching and the specified TTL for each entry
 func WithCacheTTL(ttl time.Duration) func(*Plugin) {
 	return func(p *Plugin) {
 		p.cacheTTL = ttl
 	}
 }
+
+// WithCacheErrorTTL configures the TTL for transient errors, e.g. SCM server errors or rate limits. 0 disables caching
+// them. Other errors are cached with the regular TTL.
+func WithCacheErrorTTL(ttl time.Duration) func(*Plugin) {
+	return func(p *Plugin) {
+		p.cacheErrorTTL = ttl
+	}
+}
+
+// WithCacheDir stores the cache entries in dir, so they survive restarts. The entry limits do not apply.
+func WithCacheDir(dir string) func(*Plugin) {
+	return func(p *Plugin) {
+		p.cacheDir = dir
+	}
+}
+
+// WithCacheRedis stores the cache entries in redis, so they are shared between replicas. It takes precedence over
+// WithCacheDir. The entry limits do not apply.
+func WithCacheRedis(options *redis.Options) func(*Plugin) {
+	return func(p *Plugin) {
+		p.cacheRedis = options
+	}
+}
+
+// WithCacheMaxEntries limits the number of entries in the in memory cache. 0 disables the limit.
+func WithCacheMaxEntries(maxEntries int) func(*Plugin) {
+	return func(p *Plugin) {
+		p.cacheMaxEntries = maxEntries
+	}
+}
+
+// WithCacheMaxBytes limits the estimated size of the entries in the in memory cache. 0 disables the limit.
+func WithCacheMaxBytes(maxBytes int64) func(*Plugin) {
+	return func(p *Plugin) {
+		p.cacheMaxBytes = maxBytes
+	}
+}
+
+// WithScmCacheMaxBytes caches file contents and listings by commit id up to the estimated size. 0 disables the cache.
+func WithScmCacheMaxBytes(maxBytes int64) func(*Plugin) {
+	return func(p *Plugin) {
+		p.scmCacheBytes = maxBytes
+	}
+}
+
+// WithScmCacheNotFoundTTL caches files which do not exist at a commit for the TTL. 0 disables caching them.
+func WithScmCacheNotFoundTTL(ttl time.Duration) func(*Plugin) {
+	return func(p *Plugin) {
+		p.scmNotFoundTTL = ttl
+	}
+}
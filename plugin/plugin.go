@@ -5,6 +5,7 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients"
@@ -12,7 +13,11 @@ import (
 	"github.com/drone/drone-go/plugin/config"
 
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type (
@@ -26,15 +31,34 @@ type (
 		bitBucketClient     string
 		bitBucketSecret     string
 
-		concat        bool
-		fallback      bool
-		alwaysRunAll  bool
-		finalize      bool
-		maxDepth      int
-		allowListFile string
-		considerFile  string
-		cacheTTL      time.Duration
-		cache         *configCache
+		concat          bool
+		fallback        bool
+		failOnFetchErr  bool
+		alwaysRunAll    bool
+		mergeBase       bool
+		eventStrategies map[string]Strategy
+		tagPattern      *regexp.Regexp
+		finalize        bool
+		maxDepth        int
+		allowListFile   string
+		considerFile    string
+		cacheTTL        time.Duration
+		cacheErrorTTL   time.Duration
+		cacheMaxEntries int
+		cacheMaxBytes   int64
+		cacheDir        string
+		cacheRedis      *redis.Options
+		cache           *configCache
+		scmCacheBytes   int64
+		scmNotFoundTTL  time.Duration
+		scmCache        *scm_clients.FileCache
+		requestTimeout  time.Duration
+		concurrency     int
+		inflight        singleflight.Group
+		// credentialsVerified is the time of the last successful SCM credentials check in unix nanoseconds
+		credentialsVerified atomic.Int64
+		// inflightJoined is called by each request once it has joined the in-flight requests, used by the tests
+		inflightJoined func()
 	}
 
 	droneConfig struct {
@@ -45,28 +69,64 @@ type (
 	request struct {
 		*config.Request
 		UUID         uuid.UUID
+		Log          *logrus.Entry
 		Client       scm_clients.ScmClient
 		ConsiderData *ConsiderData
+		// fetchFailed is set when a config was skipped because it could not be downloaded
+		fetchFailed atomic.Bool
 	}
 )
 
 // New creates a drone plugin
-func New(options ...func(*Plugin)) config.Plugin {
-	p := &Plugin{
-		cache: &configCache{},
-	}
+func New(options ...func(*Plugin)) *Plugin {
+	p := &Plugin{}
 	for _, opt := range options {
 		opt(p)
 	}
 
+	switch {
+	case p.cacheRedis != nil:
+		p.cache = newConfigCache(newRedisCache(p.cacheRedis))
+	case p.cacheDir != "":
+		p.cache = newConfigCache(newDiskCache(p.cacheDir))
+	default:
+		p.cache = newConfigCache(newMemoryCache(p.cacheMaxEntries, p.cacheMaxBytes))
+	}
+	if p.scmCacheBytes > 0 {
+		p.scmCache = scm_clients.NewFileCache(p.scmCacheBytes, p.scmNotFoundTTL)
+	}
+
 	return p
 }
 
 // Find is called by drone
-func (p *Plugin) Find(ctx context.Context, droneRequest *config.Request) (*drone.Config, error) {
+func (p *Plugin) Find(ctx context.Context, droneRequest *config.Request) (droneConfig *drone.Config, err error) {
 	someUuid := uuid.New()
-	logrus.Infof("%s %s/%s started", someUuid, droneRequest.Repo.Namespace, droneRequest.Repo.Name)
-	defer logrus.Infof("%s finished", someUuid)
+	log := logrus.WithFields(logrus.Fields{
+		"request_id": someUuid.String(),
+		"slug":       droneRequest.Repo.Slug,
+		"ref":        droneRequest.Build.Ref,
+		"after":      droneRequest.Build.After,
+		"provider":   p.provider(),
+	})
+	log.Info("started")
+	defer log.Info("finished")
+	defer func(start time.Time) { observeFind(start, droneConfig, err) }(time.Now())
+
+	ctx, span := tracer.Start(ctx, "Find", trace.WithAttributes(
+		attribute.String("request.id", someUuid.String()),
+		attribute.String("repo.slug", droneRequest.Repo.Slug),
+		attribute.String("build.ref", droneRequest.Build.Ref),
+		attribute.String("build.after", droneRequest.Build.After),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// limit the time spent on the SCM calls
+	if p.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.requestTimeout)
+		defer cancel()
+	}
 
 	// connect to scm
 	client, err := p.NewScmClient(ctx, someUuid, droneRequest.Repo)
@@ -77,11 +137,12 @@ func (p *Plugin) Find(ctx context.Context, droneRequest *config.Request) (*drone
 	req := request{
 		Request: droneRequest,
 		UUID:    someUuid,
+		Log:     log,
 		Client:  client,
 	}
 
 	// make sure this plugin is enabled for the requested repo slug
-	if ok := p.allowlisted(&req); !ok {
+	if ok := p.allowlisted(ctx, &req); !ok {
 		// do the default behavior by returning nil, nil
 		return nil, nil
 	}
@@ -102,38 +163,65 @@ func (p *Plugin) Find(ctx context.Context, droneRequest *config.Request) (*drone
 // getConfig retrieves drone config data. When the cache is enabled, this func will first check entries in
 // the cache as well as add new entries.
 func (p *Plugin) getConfig(ctx context.Context, req *request) (*drone.Config, error) {
-	logrus.WithFields(logrus.Fields{
-		"after":   req.Build.After,
+	req.Log.WithFields(logrus.Fields{
 		"before":  req.Build.Before,
 		"branch":  req.Repo.Branch,
-		"ref":     req.Build.Ref,
-		"slug":    req.Repo.Slug,
+		"event":   req.Build.Event,
 		"trigger": req.Build.Trigger,
-	}).Debugf("drone-tree-config environment")
+	}).Debug("drone-tree-config environment")
 
 	// check cache first, when enabled
 	ck := newCacheKey(req)
 	if p.cacheTTL > 0 {
-		if cached, exists := p.cache.retrieve(req.UUID, ck); exists {
+		if cached, exists := p.cache.retrieve(ctx, req.Log, ck); exists {
 			if cached != nil {
 				return &drone.Config{Data: cached.config}, cached.error
 			}
 		}
 	}
 
-	// fetch the config data. cache it, when enabled
-	return p.cacheAndReturn(
-		req.UUID, ck,
-		newCacheEntry(
-			p.getConfigData(ctx, req),
-		),
-	)
+	// fetch the config data. cache it, when enabled. concurrent identical requests wait for the first one and share
+	// its result. the work is not bound to the context of the first request, so each request only gives up waiting
+	// when its own context is done.
+	leader := false
+	results := p.inflight.DoChan(ck.hash(), func() (interface{}, error) {
+		leader = true
+		ctx, cancel := p.sharedContext(ctx)
+		defer cancel()
+		entry := newCacheEntry(p.getConfigData(ctx, req))
+		entry.incomplete = req.fetchFailed.Load()
+		return p.cacheAndReturn(ctx, req.Log, ck, entry)
+	})
+	if p.inflightJoined != nil {
+		p.inflightJoined()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		if !leader {
+			req.Log.Debug("shared result with a concurrent identical request")
+			findCoalescedTotal.Inc()
+		}
+		return result.Val.(*drone.Config), result.Err
+	}
+}
+
+// sharedContext returns the context for work shared by concurrent identical requests. It keeps the span of ctx, but
+// is not cancelled with it and has its own request timeout.
+func (p *Plugin) sharedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	shared := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+	if p.requestTimeout > 0 {
+		return context.WithTimeout(shared, p.requestTimeout)
+	}
+	return context.WithCancel(shared)
 }
 
 // getConfigData retrieves drone config data from the repo
 func (p *Plugin) getConfigData(ctx context.Context, req *request) (string, error) {
-	// get changed files
-	changedFiles, err := p.getScmChanges(ctx, req)
+	// get changed files, as selected by the strategy of the event
+	selected, err := p.selectConfigs(ctx, req)
 	if err != nil {
 		return "", err
 	}
@@ -142,23 +230,30 @@ func (p *Plugin) getConfigData(ctx context.Context, req *request) (string, error
 	var dcc *DroneConfigCombiner
 
 	if p.alwaysRunAll {
-		logrus.Warnf("%s always run all enabled, rebuilding all", req.UUID)
+		req.Log.Warn("always run all enabled, rebuilding all")
+		if p.considerFile == "" {
+			req.Log.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
+		}
+		dcc, err = p.getConfigForTree(ctx, req, "", 0)
+	} else if selected.all {
 		if p.considerFile == "" {
-			logrus.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
+			req.Log.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
 		}
 		dcc, err = p.getConfigForTree(ctx, req, "", 0)
-	} else if changedFiles != nil {
-		dcc, err = p.getConfigForChanges(ctx, req, changedFiles)
+	} else if selected.dirs != nil {
+		dcc, err = p.getConfigForDirs(ctx, req, selected.dirs)
+	} else if selected.changedFiles != nil {
+		dcc, err = p.getConfigForChanges(ctx, req, selected.changedFiles)
 	} else if req.Build.Trigger == "@cron" {
-		logrus.Warnf("%s @cron, rebuilding all", req.UUID)
+		req.Log.Warn("@cron, rebuilding all")
 		if p.considerFile == "" {
-			logrus.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
+			req.Log.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
 		}
 		dcc, err = p.getConfigForTree(ctx, req, "", 0)
 	} else if p.fallback {
-		logrus.Warnf("%s no changed files and fallback enabled, rebuilding all", req.UUID)
+		req.Log.Warn("no changed files and fallback enabled, rebuilding all")
 		if p.considerFile == "" {
-			logrus.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
+			req.Log.Warnf("recursively scanning for config files with max depth %d", p.maxDepth)
 		}
 		dcc, err = p.getConfigForTree(ctx, req, "", 0)
 	}
@@ -168,11 +263,16 @@ func (p *Plugin) getConfigData(ctx context.Context, req *request) (string, error
 
 	// no file found
 	if dcc == nil {
-		return "", errors.New("did not find a .drone.yml")
+		return "", &configError{errors.New("did not find a .drone.yml")}
 	}
 
 	// combine
+	configsCombined.Observe(float64(len(dcc.LoadedConfigs)))
+	_, span := tracer.Start(ctx, "Combine", trace.WithAttributes(
+		attribute.Int("configs", len(dcc.LoadedConfigs)),
+	))
 	configData := dcc.Combine(p.finalize)
+	span.End()
 
 	return configData, nil
 }
@@ -2,18 +2,40 @@ package plugin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients"
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients/scmtest"
 	"github.com/drone/drone-go/drone"
 	"github.com/drone/drone-go/plugin/config"
+	"github.com/google/go-github/v33/github"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var noContext = context.Background()
@@ -226,6 +248,243 @@ func TestPullRequestWithConsider(t *testing.T) {
 	}
 }
 
+// test the first push of a new branch
+func TestMergeBase(t *testing.T) {
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "0000000000000000000000000000000000000000",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:    "refs/heads/feature",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Branch:    "master",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+
+	// without merge base only the last commit is compared, which changed nothing in the mock
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithMaxDepth(2),
+	)
+	if droneConfig, _ := plugin.Find(noContext, req); droneConfig != nil {
+		t.Errorf("Want no config got %q", droneConfig.Data)
+	}
+
+	plugin = New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithMaxDepth(2),
+		WithMergeBase(true),
+	)
+	droneConfig, err := plugin.Find(noContext, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if droneConfig == nil {
+		t.Fatal("Want config got nil")
+	}
+	if want, got := "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n", droneConfig.Data; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestEventStrategies(t *testing.T) {
+	const changes = "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n"
+	const all = "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n"
+
+	strategies, err := ParseEventStrategies(map[string]string{"tag": "previous-tag", "promote": "all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithMaxDepth(2),
+		WithEventStrategies(strategies),
+	)
+	for name, tc := range map[string]struct {
+		event string
+		ref   string
+		want  string
+	}{
+		"PreviousTag":   {event: "tag", ref: "refs/tags/v1.10.0", want: changes},
+		"FirstTag":      {event: "tag", ref: "refs/tags/v0.9.0", want: all},
+		"FirstOfPrefix": {event: "tag", ref: "refs/tags/svc/v1.0.0", want: all},
+		"Promote":       {event: "promote", ref: "refs/heads/master", want: all},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := &config.Request{
+				Build: drone.Build{
+					After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+					Event: tc.event,
+					Ref:   tc.ref,
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			droneConfig, err := plugin.Find(noContext, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tc.want, droneConfig.Data; want != got {
+				t.Errorf("Want %q got %q", want, got)
+			}
+		})
+	}
+
+	if _, err := ParseEventStrategies(map[string]string{"tag": "unknown"}); err == nil {
+		t.Error("Want error for unknown strategy")
+	}
+}
+
+func TestTagPrefix(t *testing.T) {
+	// only the config of the directory is selected, without the root config
+	const want = "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n"
+
+	strategies := map[string]Strategy{"tag": StrategyTagPrefix}
+	releasePattern, err := ParseTagPattern(`^release-(.+)-v[0-9.]+$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		pattern *regexp.Regexp
+		ref     string
+	}{
+		"Directory":     {ref: "refs/tags/afolder/v1.4.0"},
+		"Nested":        {ref: "refs/tags/a/b/v0.1.0"},
+		"CustomPattern": {pattern: releasePattern, ref: "refs/tags/release-a/b-v2.0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			plugin := New(
+				WithServer(ts.URL),
+				WithGithubToken(mockToken),
+				WithConcat(true),
+				WithEventStrategies(strategies),
+				WithTagPattern(tc.pattern),
+			)
+			req := &config.Request{
+				Build: drone.Build{
+					After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+					Event: "tag",
+					Ref:   tc.ref,
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			droneConfig, err := plugin.Find(noContext, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := droneConfig.Data; want != got {
+				t.Errorf("Want %q got %q", want, got)
+			}
+		})
+	}
+
+	if _, err := ParseTagPattern(`^v[0-9.]+$`); err == nil {
+		t.Error("Want error for pattern without group")
+	}
+}
+
+func TestParams(t *testing.T) {
+	const dir = "---\nkind: pipeline\nname: default\n\nsteps:\n- name: build\n  image: golang\n  commands:\n  - go build\n  - go test -short\n\n- name: integration\n  image: golang\n  commands:\n  - go test -v\n"
+	const root = "---\nkind: pipeline\nname: default\n\nsteps:\n- name: frontend\n  image: node\n  commands:\n  - npm install\n  - npm test\n\n- name: backend\n  image: golang\n  commands:\n  - go build\n  - go test\n"
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithConcat(true),
+		WithMaxDepth(2),
+	)
+	for name, tc := range map[string]struct {
+		paths string
+		want  string
+	}{
+		"Directory": {paths: "afolder", want: dir},
+		"Multiple":  {paths: "/, a/b/.drone.yml, ../outside", want: root + dir},
+		"All":       {paths: "*", want: root + dir},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := &config.Request{
+				Build: drone.Build{
+					After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+					Event:  "custom",
+					Ref:    "refs/heads/master",
+					Params: map[string]string{PathsParam: tc.paths},
+				},
+				Repo: drone.Repo{
+					Namespace: "foosinn",
+					Name:      "dronetest",
+					Slug:      "foosinn/dronetest",
+					Config:    ".drone.yml",
+				},
+			}
+			droneConfig, err := plugin.Find(noContext, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tc.want, droneConfig.Data; want != got {
+				t.Errorf("Want %q got %q", want, got)
+			}
+		})
+	}
+
+	// a directory without config is an error, instead of the default config of drone
+	req := &config.Request{
+		Build: drone.Build{
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Event:  "custom",
+			Params: map[string]string{PathsParam: "a"},
+		},
+		Repo: drone.Repo{Namespace: "foosinn", Name: "dronetest", Slug: "foosinn/dronetest", Config: ".drone.yml"},
+	}
+	if _, err := plugin.Find(noContext, req); err == nil {
+		t.Error("Want error for a directory without config")
+	}
+
+	// the selected paths are part of the cache key
+	key := &request{Request: &config.Request{Build: drone.Build{Params: map[string]string{PathsParam: "afolder"}}}}
+	if newCacheKey(key).hash() == newCacheKey(&request{Request: &config.Request{}}).hash() {
+		t.Error("Want different cache keys for different paths")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.10.0", "v1.9.2", 1},
+		{"1.2", "1.2.0", 0},
+		{"v1.2.0-rc1", "v1.2.0", -1},
+		{"v1.2.0-rc1", "v1.2.0-rc2", -1},
+		{"v1.2.0-rc9", "v1.2.0-rc10", -1},
+		{"v1.2.0-rc10", "v1.2.0-rc9", 1},
+		{"v1.2.0-beta.2", "v1.2.0-beta.11", -1},
+		{"v1.2.0-beta", "v1.2.0-beta.1", -1},
+		{"v1.2.0-beta.1", "v1.2.0-rc.1", -1},
+		{"v2", "v1.99", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q): want %d got %d", tc.a, tc.b, tc.want, got)
+		}
+	}
+}
+
 func TestCron(t *testing.T) {
 	req := &config.Request{
 		Build: drone.Build{
@@ -274,6 +533,7 @@ func TestCache(t *testing.T) {
 	r := &request{
 		Request: req,
 		UUID:    uuid.New(),
+		Log:     logrus.NewEntry(logrus.StandardLogger()),
 	}
 	ck := newCacheKey(r)
 
@@ -283,7 +543,7 @@ func TestCache(t *testing.T) {
 		concat:      true,
 		maxDepth:    2,
 		cacheTTL:    time.Minute * 1,
-		cache:       &configCache{},
+		cache:       newConfigCache(newMemoryCache(0, 0)),
 	}
 
 	// test cache hit
@@ -294,7 +554,7 @@ func TestCache(t *testing.T) {
 			return
 		}
 
-		if entry, ok := p.cache.retrieve(r.UUID, ck); ok {
+		if entry, ok := p.cache.retrieve(noContext, r.Log, ck); ok {
 			if want := droneConfig.Data; entry.config != want {
 				t.Errorf("Want %q got %q", droneConfig.Data, entry.config)
 			}
@@ -307,13 +567,757 @@ func TestCache(t *testing.T) {
 	}
 
 	// test cache expire
-	p.cache.expire(ck)
-	entry, ok := p.cache.retrieve(r.UUID, ck)
+	_ = p.cache.backend.set(noContext, &cacheEntry{key: ck, expires: time.Now().Add(-time.Second)})
+	entry, ok := p.cache.retrieve(noContext, r.Log, ck)
 	if entry != nil || ok {
 		t.Error("entry still in cache")
 	}
 }
 
+func TestCacheLimits(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	keys := []cacheKey{{slug: "a"}, {slug: "b"}, {slug: "c"}}
+
+	// entry limit, the least recently used entry is evicted
+	c := newConfigCache(newMemoryCache(2, 0))
+	c.add(noContext, log, keys[0], newCacheEntry("config-a", nil), time.Minute)
+	c.add(noContext, log, keys[1], newCacheEntry("config-b", nil), time.Minute)
+	if _, ok := c.retrieve(noContext, log, keys[0]); !ok {
+		t.Error("entry a not in cache")
+	}
+	c.add(noContext, log, keys[2], newCacheEntry("config-c", nil), time.Minute)
+	for key, want := range map[cacheKey]bool{keys[0]: true, keys[1]: false, keys[2]: true} {
+		if _, got := c.retrieve(noContext, log, key); want != got {
+			t.Errorf("Want %+v in cache %v got %v", key, want, got)
+		}
+	}
+
+	// byte limit
+	m := newMemoryCache(0, 20)
+	c = newConfigCache(m)
+	c.add(noContext, log, keys[0], newCacheEntry("0123456789", nil), time.Minute)
+	c.add(noContext, log, keys[1], newCacheEntry("0123456789", nil), time.Minute)
+	if _, ok := c.retrieve(noContext, log, keys[0]); ok {
+		t.Error("entry a still in cache")
+	}
+	if want, got := int64(11), m.bytes; want != got {
+		t.Errorf("Want %d bytes got %d", want, got)
+	}
+
+	// expiry
+	m = newMemoryCache(0, 0)
+	c = newConfigCache(m)
+	c.add(noContext, log, keys[0], newCacheEntry("config-a", nil), time.Minute)
+	c.add(noContext, log, keys[1], newCacheEntry("config-b", nil), time.Hour)
+	m.expireAll(time.Now().Add(2 * time.Minute))
+	if _, ok := c.retrieve(noContext, log, keys[0]); ok {
+		t.Error("entry a still in cache")
+	}
+	if _, ok := c.retrieve(noContext, log, keys[1]); !ok {
+		t.Error("entry b not in cache")
+	}
+	if want, got := 1, m.lru.Len(); want != got {
+		t.Errorf("Want %d entries got %d", want, got)
+	}
+}
+
+func TestCacheErrorPolicy(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	p := &Plugin{
+		cacheTTL: time.Hour,
+		cache:    newConfigCache(newMemoryCache(0, 0)),
+	}
+	transient := &url.Error{Op: "Get", URL: ts.URL, Err: errors.New("connection reset")}
+	permanent := &configError{errors.New("did not find a .drone.yml")}
+
+	// transient errors are not cached by default
+	const sha = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	keys := []cacheKey{{slug: "a", after: sha}, {slug: "b", after: sha}, {slug: "c", after: sha}}
+	_, _ = p.cacheAndReturn(noContext, log, keys[0], newCacheEntry("", transient))
+	_, _ = p.cacheAndReturn(noContext, log, keys[1], newCacheEntry("", permanent))
+	if _, ok := p.cache.retrieve(noContext, log, keys[0]); ok {
+		t.Error("transient error in cache")
+	}
+	entry, ok := p.cache.retrieve(noContext, log, keys[1])
+	if !ok {
+		t.Fatal("permanent error not in cache")
+	}
+	if remaining := time.Until(entry.expires); remaining < 59*time.Minute {
+		t.Errorf("Want permanent error cached for %s got %s", p.cacheTTL, remaining)
+	}
+
+	// transient errors are cached with the error ttl
+	p.cacheErrorTTL = time.Minute
+	_, _ = p.cacheAndReturn(noContext, log, keys[2], newCacheEntry("", transient))
+	entry, ok = p.cache.retrieve(noContext, log, keys[2])
+	if !ok {
+		t.Fatal("transient error not in cache")
+	}
+	if remaining := time.Until(entry.expires); remaining > time.Minute {
+		t.Errorf("Want transient error cached for %s got %s", p.cacheErrorTTL, remaining)
+	}
+
+	// errors which may be fixed without a new commit are cached with the error ttl
+	for name, tc := range map[string]struct {
+		key        cacheKey
+		err        error
+		incomplete bool
+	}{
+		"Unauthorized": {key: cacheKey{slug: "d", after: sha}, err: githubError(401)},
+		"Forbidden":    {key: cacheKey{slug: "e", after: sha}, err: githubError(403)},
+		"Truncated":    {key: cacheKey{slug: "f", after: sha}, err: fmt.Errorf("unable to compare: %w", scm_clients.ErrTreeTruncated)},
+		"Branch":       {key: cacheKey{slug: "g", after: "master"}, err: permanent},
+		"NoStatus":     {key: cacheKey{slug: "h", after: sha}, err: errors.New("unexpected EOF")},
+		"Incomplete":   {key: cacheKey{slug: "i", after: sha}, incomplete: true},
+	} {
+		entry := newCacheEntry("", tc.err)
+		entry.incomplete = tc.incomplete
+		_, _ = p.cacheAndReturn(noContext, log, tc.key, entry)
+		entry, ok := p.cache.retrieve(noContext, log, tc.key)
+		if !ok {
+			t.Fatalf("%s: error not in cache", name)
+		}
+		if remaining := time.Until(entry.expires); remaining > time.Minute {
+			t.Errorf("%s: want error cached for %s got %s", name, p.cacheErrorTTL, remaining)
+		}
+	}
+}
+
+func TestFetchError(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	p := &Plugin{}
+
+	// files which can not be downloaded are skipped by default, the request is marked as incomplete
+	req := &request{Log: log}
+	if _, critical, _ := p.parseDroneConfig(req, ".drone.yml", "", githubError(502)); critical {
+		t.Error("Want a failed download to be skipped")
+	}
+	if !req.fetchFailed.Load() {
+		t.Error("Want the request to be marked as incomplete")
+	}
+
+	// files which do not exist are always skipped
+	req = &request{Log: log}
+	p.failOnFetchErr = true
+	if _, critical, _ := p.parseDroneConfig(req, ".drone.yml", "", githubError(404)); critical || req.fetchFailed.Load() {
+		t.Error("Want a missing file to be skipped")
+	}
+	if _, critical, _ := p.parseDroneConfig(req, ".drone.yml", "", githubError(502)); !critical {
+		t.Error("Want a failed download to be critical")
+	}
+}
+
+// githubError returns the error of a github request which failed with the status code
+func githubError(statusCode int) error {
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	return &github.ErrorResponse{Response: &http.Response{StatusCode: statusCode, Request: req}}
+}
+
+func TestDiskCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	dir, err := ioutil.TempDir("", "drone-tree-config-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := []cacheKey{{slug: "a", after: "1"}, {slug: "b", after: "2"}}
+	c := newConfigCache(newDiskCache(dir))
+	if err := c.ping(noContext); err != nil {
+		t.Error(err)
+	}
+	c.add(noContext, log, keys[0], newCacheEntry("config-a", nil), time.Minute)
+	c.add(noContext, log, keys[1], newCacheEntry("", errors.New("did not find a .drone.yml")), time.Hour)
+
+	// entries survive a restart
+	d := newDiskCache(dir)
+	c = newConfigCache(d)
+	entry, ok := c.retrieve(noContext, log, keys[0])
+	if !ok {
+		t.Fatal("entry a not in cache")
+	}
+	if want, got := "config-a", entry.config; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	if entry.error != nil {
+		t.Errorf("Want no error got %q", entry.error)
+	}
+	entry, ok = c.retrieve(noContext, log, keys[1])
+	if !ok {
+		t.Fatal("entry b not in cache")
+	}
+	if entry.error == nil || entry.error.Error() != "did not find a .drone.yml" {
+		t.Errorf("Want error got %v", entry.error)
+	}
+
+	// expiry
+	d.expireAll(time.Now().Add(2 * time.Minute))
+	if _, ok := c.retrieve(noContext, log, keys[0]); ok {
+		t.Error("entry a still in cache")
+	}
+	if _, ok := c.retrieve(noContext, log, keys[1]); !ok {
+		t.Error("entry b not in cache")
+	}
+	_, _ = c.backend.delete(noContext, keys[1])
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 0 {
+		t.Errorf("Want no files got %v", files)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	mr := miniredis.RunT(t)
+
+	keys := []cacheKey{{slug: "a", after: "1"}, {slug: "b", after: "2"}}
+	c := newConfigCache(newRedisCache(&redis.Options{Addr: mr.Addr()}))
+	if err := c.ping(noContext); err != nil {
+		t.Error(err)
+	}
+	c.add(noContext, log, keys[0], newCacheEntry("config-a", nil), time.Minute)
+	c.add(noContext, log, keys[1], newCacheEntry("", errors.New("did not find a .drone.yml")), time.Hour)
+
+	// the ttl is set server side
+	if ttl := mr.TTL(redisKey(keys[0])); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Want ttl of up to %s got %s", time.Minute, ttl)
+	}
+
+	// the entries are indexed per repo, the index expires with its latest entry
+	c.add(noContext, log, cacheKey{slug: "a", after: "3"}, newCacheEntry("config-a", nil), time.Second)
+	members, err := mr.Members(redisIndexKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(members); want != got {
+		t.Errorf("Want %d indexed entries got %d", want, got)
+	}
+	if ttl := mr.TTL(redisIndexKey("a")); ttl <= time.Second || ttl > time.Minute {
+		t.Errorf("Want index ttl of up to %s got %s", time.Minute, ttl)
+	}
+
+	// purging a repo only checks its index and removes expired entries from it
+	mr.FastForward(2 * time.Second)
+	unindexed := cacheKey{slug: "a", after: "4"}
+	data, _ := encodeCacheEntry(&cacheEntry{key: unindexed, config: "config-a", expires: time.Now().Add(time.Minute)})
+	_ = mr.Set(redisKey(unindexed), string(data))
+	purged, err := c.purge(noContext, "a", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, purged; want != got {
+		t.Errorf("Want %d purged got %d", want, got)
+	}
+	if mr.Exists(redisIndexKey("a")) {
+		t.Error("Want empty index to be removed")
+	}
+	if !mr.Exists(redisKey(unindexed)) {
+		t.Error("Want unindexed entry to be kept")
+	}
+	c.add(noContext, log, keys[0], newCacheEntry("config-a", nil), time.Minute)
+
+	// entries are shared between replicas
+	c = newConfigCache(newRedisCache(&redis.Options{Addr: mr.Addr()}))
+	entry, ok := c.retrieve(noContext, log, keys[0])
+	if !ok {
+		t.Fatal("entry a not in cache")
+	}
+	if want, got := "config-a", entry.config; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	entry, ok = c.retrieve(noContext, log, keys[1])
+	if !ok {
+		t.Fatal("entry b not in cache")
+	}
+	if entry.error == nil || entry.error.Error() != "did not find a .drone.yml" {
+		t.Errorf("Want error got %v", entry.error)
+	}
+
+	// expiry
+	mr.FastForward(2 * time.Minute)
+	if _, ok := c.retrieve(noContext, log, keys[0]); ok {
+		t.Error("entry a still in cache")
+	}
+	_, _ = c.backend.delete(noContext, keys[1])
+	if _, ok := c.retrieve(noContext, log, keys[1]); ok {
+		t.Error("entry b still in cache")
+	}
+
+	// unreachable server
+	mr.Close()
+	if err := c.ping(noContext); err == nil {
+		t.Error("Want error for unreachable server")
+	}
+	if _, ok := c.retrieve(noContext, log, keys[0]); ok {
+		t.Error("Want miss for unreachable server")
+	}
+}
+
+func TestPurgeCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	dir, err := ioutil.TempDir("", "drone-tree-config-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mr := miniredis.RunT(t)
+
+	backends := map[string]cacheBackend{
+		"memory": newMemoryCache(0, 0),
+		"disk":   newDiskCache(dir),
+		"redis":  newRedisCache(&redis.Options{Addr: mr.Addr()}),
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			p := &Plugin{cache: newConfigCache(backend)}
+			keys := []cacheKey{
+				{slug: "foosinn/dronetest", ref: "refs/heads/master", before: "1", after: "2"},
+				{slug: "foosinn/dronetest", ref: "refs/heads/feature", before: "2", after: "3"},
+				{slug: "foosinn/other", ref: "refs/heads/master", before: "4", after: "5"},
+			}
+			add := func() {
+				for _, key := range keys {
+					p.cache.add(noContext, log, key, newCacheEntry("config", nil), time.Minute)
+				}
+			}
+
+			if _, err := p.PurgeCache(noContext, "", "", ""); err == nil {
+				t.Error("Want error for empty filter")
+			}
+
+			tests := []struct {
+				slug, ref, sha string
+				purged         []bool
+			}{
+				{slug: "foosinn/dronetest", purged: []bool{true, true, false}},
+				{slug: "foosinn/dronetest", ref: "refs/heads/master", purged: []bool{true, false, false}},
+				{ref: "refs/heads/master", purged: []bool{true, false, true}},
+				{sha: "2", purged: []bool{true, true, false}},
+			}
+			for _, test := range tests {
+				add()
+				purged, err := p.PurgeCache(noContext, test.slug, test.ref, test.sha)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := 0
+				for i, key := range keys {
+					_, ok := p.cache.retrieve(noContext, log, key)
+					if ok == test.purged[i] {
+						t.Errorf("Purge %+v: want %+v purged %v", test, key, test.purged[i])
+					}
+					if test.purged[i] {
+						want++
+					}
+				}
+				if want != purged {
+					t.Errorf("Purge %+v: want %d purged got %d", test, want, purged)
+				}
+			}
+		})
+	}
+}
+
+// blockingClient counts the calls to ChangedFilesInDiff and blocks them until the expected number of requests has
+// joined the in-flight request
+type blockingClient struct {
+	scm_clients.ScmClient
+	calls   int32
+	joined  chan struct{}
+	release chan struct{}
+}
+
+func newBlockingClient(requests int) *blockingClient {
+	return &blockingClient{joined: make(chan struct{}, requests), release: make(chan struct{})}
+}
+
+// join is called by each request once it waits for the in-flight request
+func (c *blockingClient) join() {
+	c.joined <- struct{}{}
+	if len(c.joined) == cap(c.joined) {
+		close(c.release)
+	}
+}
+
+func (c *blockingClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	atomic.AddInt32(&c.calls, 1)
+	<-c.release
+	return nil, errors.New("diff failed")
+}
+
+func TestCoalescing(t *testing.T) {
+	const concurrent = 5
+	for name, tc := range map[string]struct {
+		cancelFirst bool
+	}{
+		"Shared":         {},
+		"FirstCancelled": {cancelFirst: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := newBlockingClient(concurrent)
+			p := &Plugin{
+				cache:          newConfigCache(newMemoryCache(0, 0)),
+				inflightJoined: client.join,
+			}
+			newRequest := func() *request {
+				return &request{
+					Request: &config.Request{
+						Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+						Repo:  drone.Repo{Slug: "foosinn/dronetest"},
+					},
+					UUID:   uuid.New(),
+					Log:    logrus.NewEntry(logrus.StandardLogger()),
+					Client: client,
+				}
+			}
+
+			// the first request starts the SCM call, its context is cancelled once all requests have joined
+			ctx, cancel := context.WithCancel(noContext)
+			defer cancel()
+			first := make(chan error, 1)
+			go func() {
+				_, err := p.getConfig(ctx, newRequest())
+				first <- err
+			}()
+			for atomic.LoadInt32(&client.calls) == 0 {
+				runtime.Gosched()
+			}
+			if tc.cancelFirst {
+				cancel()
+				if err := <-first; !errors.Is(err, context.Canceled) {
+					t.Errorf("Want cancelled first request got %v", err)
+				}
+			}
+
+			coalescedBefore := testutil.ToFloat64(findCoalescedTotal)
+			errs := make(chan error, concurrent-1)
+			for i := 1; i < concurrent; i++ {
+				go func() {
+					_, err := p.getConfig(noContext, newRequest())
+					errs <- err
+				}()
+			}
+			for i := 1; i < concurrent; i++ {
+				if err := <-errs; err == nil || err.Error() != "diff failed" {
+					t.Errorf("Want shared error got %v", err)
+				}
+			}
+			if !tc.cancelFirst {
+				if err := <-first; err == nil || err.Error() != "diff failed" {
+					t.Errorf("Want shared error got %v", err)
+				}
+			}
+
+			if want, got := int32(1), atomic.LoadInt32(&client.calls); want != got {
+				t.Errorf("Want %d SCM call got %d", want, got)
+			}
+			// only the requests which waited for the first one are counted
+			if want, got := coalescedBefore+concurrent-1, testutil.ToFloat64(findCoalescedTotal); want != got {
+				t.Errorf("Want %v coalesced requests got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	req := &config.Request{
+		Build: drone.Build{
+			After:   "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Trigger: "@cron",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithConcat(true),
+		WithMaxDepth(2),
+	)
+
+	configBefore := testutil.ToFloat64(findRequestsTotal.WithLabelValues(outcomeConfig))
+	nilBefore := testutil.ToFloat64(findRequestsTotal.WithLabelValues(outcomeNil))
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := configBefore+1, testutil.ToFloat64(findRequestsTotal.WithLabelValues(outcomeConfig)); want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+
+	req.Repo.Config = ".drone.star"
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+	if want, got := nilBefore+1, testutil.ToFloat64(findRequestsTotal.WithLabelValues(outcomeNil)); want != got {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Source: "master",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Branch:    "master",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	// tracers created before keep delegating to the provider, it is shut down so they stop recording
+	defer func() {
+		otel.SetTracerProvider(previous)
+		_ = provider.Shutdown(noContext)
+	}()
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithFallback(true),
+		WithMaxDepth(2),
+		WithConsiderFile(".drone-consider"),
+	)
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["Find"]
+	if !ok {
+		t.Fatal("missing Find span")
+	}
+	for _, name := range []string{
+		"allowlisted", "newConsiderDataFromRequest", "getScmChanges",
+		"scm.ChangedFilesInDiff", "scm.GetFileContents", "Combine",
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("missing %s span", name)
+			continue
+		}
+		if want, got := root.SpanContext().TraceID(), span.SpanContext().TraceID(); want != got {
+			t.Errorf("Want trace %s got %s for %s", want, got, name)
+		}
+		if want, got := codes.Unset, span.Status().Code; want != got {
+			t.Errorf("Want status %s got %s for %s", want, got, name)
+		}
+	}
+
+	// failed SCM calls are recorded as failed spans
+	failing := &request{
+		Request: &config.Request{Build: drone.Build{Ref: "refs/pull/3/head"}},
+		Log:     logrus.NewEntry(logrus.StandardLogger()),
+		Client:  failingPullRequestClient{},
+	}
+	if _, err := plugin.getScmChanges(noContext, failing); err == nil {
+		t.Fatal("Want an error for the failed pull request diff")
+	}
+	var failed sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "getScmChanges" {
+			failed = span
+		}
+	}
+	if failed == nil {
+		t.Fatal("missing getScmChanges span for the failed pull request diff")
+	}
+	if want, got := codes.Error, failed.Status().Code; want != got {
+		t.Errorf("Want status %s got %s for the failed pull request diff", want, got)
+	}
+}
+
+// failingPullRequestClient fails to list the changed files of pull requests
+type failingPullRequestClient struct {
+	scm_clients.ScmClient
+}
+
+func (c failingPullRequestClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
+	return nil, githubError(502)
+}
+
+func TestLogFields(t *testing.T) {
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+			Ref:    "refs/heads/master",
+		},
+		Repo: drone.Repo{
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	plugin := New(
+		WithServer(ts.URL),
+		WithGithubToken(mockToken),
+		WithMaxDepth(2),
+	)
+	if _, err := plugin.Find(noContext, req); err != nil {
+		t.Error(err)
+		return
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) == 0 {
+		t.Fatal("no log entries")
+	}
+	requestID := entries[0].Data["request_id"]
+	for _, entry := range entries {
+		want := map[string]interface{}{
+			"request_id": requestID,
+			"slug":       "foosinn/dronetest",
+			"provider":   "github",
+		}
+		if _, ok := entry.Data["ref"]; ok {
+			want["ref"] = "refs/heads/master"
+			want["after"] = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+		}
+		for key, want := range want {
+			if got := entry.Data[key]; got != want {
+				t.Errorf("Want %s=%q got %q in %q", key, want, got, entry.Message)
+			}
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	invalidAllowList := filepath.Join(t.TempDir(), "invalid")
+	if err := ioutil.WriteFile(invalidAllowList, []byte("^foosinn/(.*$\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := map[string]struct {
+		options []func(*Plugin)
+		ready   bool
+	}{
+		"Ready": {
+			options: []func(*Plugin){WithServer(ts.URL), WithGithubToken(mockToken), WithAllowListFile("testdata/regex/matchall")},
+			ready:   true,
+		},
+		"NoCredentials": {
+			options: []func(*Plugin){WithServer(ts.URL)},
+			ready:   false,
+		},
+		"MissingAllowList": {
+			options: []func(*Plugin){WithServer(ts.URL), WithGithubToken(mockToken), WithAllowListFile("no_such_file")},
+			ready:   false,
+		},
+		"InvalidAllowList": {
+			options: []func(*Plugin){WithServer(ts.URL), WithGithubToken(mockToken), WithAllowListFile(invalidAllowList)},
+			ready:   false,
+		},
+	}
+
+	for name, s := range scenarios {
+		t.Run(name, func(t *testing.T) {
+			err := New(s.options...).Ready(noContext)
+			if want, got := s.ready, err == nil; want != got {
+				t.Errorf("Want ready %v got %v (%v)", want, got, err)
+			}
+		})
+	}
+}
+
+func TestReadyCredentialsInterval(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v4/user" {
+			atomic.AddInt32(&requests, 1)
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	// a successful check is reused by the following probes
+	p := New(WithGitlabServer(server.URL), WithGitlabToken(mockToken))
+	if err := p.Ready(noContext); err != nil {
+		t.Fatal(err)
+	}
+	checked := atomic.LoadInt32(&requests)
+	if checked == 0 {
+		t.Fatal("Want the credentials to be checked")
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.Ready(noContext); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, got := checked, atomic.LoadInt32(&requests); want != got {
+		t.Errorf("Want %d requests got %d", want, got)
+	}
+
+	// the credentials are checked again after the interval
+	p.credentialsVerified.Store(time.Now().Add(-credentialsCheckInterval - time.Second).UnixNano())
+	if err := p.Ready(noContext); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2*checked, atomic.LoadInt32(&requests); want != got {
+		t.Errorf("Want %d requests got %d", want, got)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	req := &config.Request{
+		Build: drone.Build{
+			Before: "2897b31ec3a1b59279a08a8ad54dc360686327f7",
+			After:  "8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		},
+		Repo: drone.Repo{
+			UID:       "1234",
+			Namespace: "foosinn",
+			Name:      "dronetest",
+			Slug:      "foosinn/dronetest",
+			Config:    ".drone.yml",
+		},
+	}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the gitlab client probes the rate limit on the base url without a context
+		if r.URL.Path == "/api/v4/" {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	plugin := New(
+		WithGitlabServer(slow.URL),
+		WithGitlabToken(mockToken),
+		WithRequestTimeout(50*time.Millisecond),
+	)
+	start := time.Now()
+	if _, err := plugin.Find(noContext, req); err == nil {
+		t.Error("Want deadline error got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Want request to be cancelled after 50ms, took %s", elapsed)
+	}
+}
+
 func TestMatchEnable(t *testing.T) {
 	req := &config.Request{
 		Build: drone.Build{
@@ -451,6 +1455,214 @@ func TestCronConcat(t *testing.T) {
 		t.Errorf("Want\n  %q\ngot\n  %q", want, got)
 	}
 }
+
+func TestConcurrency(t *testing.T) {
+	requests := map[string]*config.Request{
+		"Cron": {
+			Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899", Trigger: "@cron"},
+			Repo:  drone.Repo{Namespace: "foosinn", Name: "dronetest", Slug: "foosinn/dronetest", Config: ".drone.yml"},
+		},
+		"PullRequest": {
+			Build: drone.Build{Ref: "refs/pull/3/head", After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+			Repo:  drone.Repo{Namespace: "foosinn", Name: "dronetest", Slug: "foosinn/dronetest", Config: ".drone.yml"},
+		},
+	}
+	for name, req := range requests {
+		t.Run(name, func(t *testing.T) {
+			sequential, err := New(
+				WithServer(ts.URL),
+				WithGithubToken(mockToken),
+				WithConcat(true),
+				WithMaxDepth(2),
+				WithConcurrency(1),
+			).Find(noContext, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the combined config does not depend on the order in which the files are downloaded
+			for i := 0; i < 10; i++ {
+				concurrent, err := New(
+					WithServer(ts.URL),
+					WithGithubToken(mockToken),
+					WithConcat(true),
+					WithMaxDepth(2),
+					WithConcurrency(8),
+				).Find(noContext, req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, got := sequential.Data, concurrent.Data; want != got {
+					t.Fatalf("Want\n  %q\ngot\n  %q", want, got)
+				}
+			}
+		})
+	}
+}
+
+// treeClient serves a repo with a .drone.yml in the root and in dir "a", GetFileTree fails with treeErr if set
+type treeClient struct {
+	scm_clients.ScmClient
+	treeErr  error
+	listings int32
+}
+
+func (c *treeClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) ([]scm_clients.FileListingEntry, error) {
+	if c.treeErr != nil {
+		return nil, c.treeErr
+	}
+	return []scm_clients.FileListingEntry{
+		{Type: "dir", Name: "a", Path: "a"},
+		{Type: "file", Name: ".drone.yml", Path: "a/.drone.yml"},
+		{Type: "file", Name: ".drone.yml", Path: ".drone.yml"},
+	}, nil
+}
+
+func (c *treeClient) GetFileListing(ctx context.Context, path string, commitRef string) ([]scm_clients.FileListingEntry, error) {
+	atomic.AddInt32(&c.listings, 1)
+	if path == "" {
+		return []scm_clients.FileListingEntry{
+			{Type: "file", Name: ".drone.yml", Path: ".drone.yml"},
+			{Type: "dir", Name: "a", Path: "a"},
+		}, nil
+	}
+	return []scm_clients.FileListingEntry{{Type: "file", Name: ".drone.yml", Path: "a/.drone.yml"}}, nil
+}
+
+func (c *treeClient) GetFileContents(ctx context.Context, path string, commitRef string) (string, error) {
+	return "kind: pipeline\nname: " + path + "\n", nil
+}
+
+func TestFileTree(t *testing.T) {
+	p := &Plugin{concat: true, maxDepth: 2}
+	for name, client := range map[string]*treeClient{
+		"Tree":      {},
+		"Truncated": {treeErr: scm_clients.ErrTreeTruncated},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := &request{
+				Request: &config.Request{
+					Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+					Repo:  drone.Repo{Slug: "foosinn/dronetest", Config: ".drone.yml"},
+				},
+				Log:    logrus.NewEntry(logrus.StandardLogger()),
+				Client: client,
+			}
+			dcc, err := p.getConfigForTree(noContext, req, "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := []string{".drone.yml", "a/.drone.yml"}, dcc.ConfigNames(nil); !reflect.DeepEqual(want, got) {
+				t.Errorf("Want %v got %v", want, got)
+			}
+
+			// the directories are only listed one by one if the tree is truncated
+			if want, got := client.treeErr != nil, atomic.LoadInt32(&client.listings) > 0; want != got {
+				t.Errorf("Want directory listings %v got %v", want, got)
+			}
+		})
+	}
+}
+
+// deepTreeClient serves a tree with a .drone.yml and the dirs "a" and "b" in each directory up to depth 3, the
+// .drone.yml files in the dirs "b" do not exist. It records the maximum number of concurrent calls.
+type deepTreeClient struct {
+	scm_clients.ScmClient
+	calls    int32
+	maxCalls int32
+	contents int32
+}
+
+func (c *deepTreeClient) enter() func() {
+	calls := atomic.AddInt32(&c.calls, 1)
+	for {
+		max := atomic.LoadInt32(&c.maxCalls)
+		if calls <= max || atomic.CompareAndSwapInt32(&c.maxCalls, max, calls) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return func() { atomic.AddInt32(&c.calls, -1) }
+}
+
+func (c *deepTreeClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) ([]scm_clients.FileListingEntry, error) {
+	return nil, scm_clients.ErrTreeTruncated
+}
+
+func (c *deepTreeClient) GetFileListing(ctx context.Context, dir string, commitRef string) ([]scm_clients.FileListingEntry, error) {
+	defer c.enter()()
+	ls := []scm_clients.FileListingEntry{{Type: "file", Name: ".drone.yml", Path: path.Join(dir, ".drone.yml")}}
+	if strings.Count(dir, "/") < 2 {
+		for _, name := range []string{"a", "b"} {
+			ls = append(ls, scm_clients.FileListingEntry{Type: "dir", Name: name, Path: path.Join(dir, name)})
+		}
+	}
+	return ls, nil
+}
+
+func (c *deepTreeClient) GetFileContents(ctx context.Context, file string, commitRef string) (string, error) {
+	defer c.enter()()
+	atomic.AddInt32(&c.contents, 1)
+	if path.Base(path.Dir(file)) == "b" {
+		return "", &github.ErrorResponse{Response: &http.Response{StatusCode: 404, Request: &http.Request{Method: "GET", URL: &url.URL{}}}}
+	}
+	return "kind: pipeline\nname: " + file + "\n", nil
+}
+
+func TestTreeWalk(t *testing.T) {
+	client := &deepTreeClient{}
+	p := &Plugin{concat: true, maxDepth: 3, concurrency: 2}
+	req := &request{
+		Request: &config.Request{
+			Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+			Repo:  drone.Repo{Slug: "foosinn/dronetest", Config: ".drone.yml"},
+		},
+		Log:    logrus.NewEntry(logrus.StandardLogger()),
+		Client: client,
+	}
+	dcc, err := p.getConfigForTree(noContext, req, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the configs are merged depth first, independent of the order they were scanned in
+	want := []string{
+		".drone.yml", "a/.drone.yml", "a/a/.drone.yml", "a/a/a/.drone.yml", "a/b/a/.drone.yml",
+		"b/a/.drone.yml", "b/a/a/.drone.yml", "b/b/a/.drone.yml",
+	}
+	if got := dcc.ConfigNames(nil); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+	if max := atomic.LoadInt32(&client.maxCalls); max > 2 {
+		t.Errorf("Want at most 2 concurrent calls got %d", max)
+	}
+}
+
+func TestChangesFirstOnly(t *testing.T) {
+	client := &deepTreeClient{}
+	p := &Plugin{concurrency: 2}
+	req := &request{
+		Request: &config.Request{
+			Build: drone.Build{After: "8ecad91991d5da985a2a8dd97cc19029dc1c2899"},
+			Repo:  drone.Repo{Slug: "foosinn/dronetest", Config: ".drone.yml"},
+		},
+		Log:    logrus.NewEntry(logrus.StandardLogger()),
+		Client: client,
+	}
+	dcc, err := p.getConfigForChanges(noContext, req, []string{"a/b/main.go", "a/a/main.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"a/.drone.yml", "a/a/.drone.yml"}, dcc.ConfigNames(nil); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+
+	// without concat the candidates above the first config of each changed file are not downloaded
+	if want, got := int32(3), atomic.LoadInt32(&client.contents); want != got {
+		t.Errorf("Want %d downloads got %d", want, got)
+	}
+}
+
 func TestAlwaysRunAll(t *testing.T) {
 	req := &config.Request{
 		Build: drone.Build{
@@ -557,6 +1769,20 @@ func testMux() *http.ServeMux {
 			f, _ := os.Open("testdata/github/compare.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/compare/master...8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		func(w http.ResponseWriter, r *http.Request) {
+			f, _ := os.Open("testdata/github/compare.json")
+			_, _ = io.Copy(w, f)
+		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/compare/v1.1.0...8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		func(w http.ResponseWriter, r *http.Request) {
+			f, _ := os.Open("testdata/github/compare.json")
+			_, _ = io.Copy(w, f)
+		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/tags",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `[{"name": "v1.10.0"}, {"name": "v1.1.0"}, {"name": "v1.0.0"}, {"name": "svc/v2.0.0"}, {"name": "latest"}]`)
+		})
 	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/contents/a/b/.drone.yml",
 		func(w http.ResponseWriter, r *http.Request) {
 			f, _ := os.Open("testdata/github/a_b_.drone.yml.json")
@@ -592,6 +1818,16 @@ func testMux() *http.ServeMux {
 			f, _ := os.Open("testdata/github/afolder_abfolder.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/git/trees/8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		func(w http.ResponseWriter, r *http.Request) {
+			f, _ := os.Open("testdata/github/tree.json")
+			_, _ = io.Copy(w, f)
+		})
+	mux.HandleFunc("/api/graphql", scmtest.GithubGraphql("testdata/github"))
+	mux.HandleFunc("/api/v3/rate_limit",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `{"resources": {"core": {"limit": 5000, "remaining": 5000, "reset": 0}}}`)
+		})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		logrus.Errorf("Url not found: %s", r.URL)
 	})
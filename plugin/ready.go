@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients"
+)
+
+// credentialsCheckInterval is the time a successful SCM credentials check is reused for, so frequent probes do not
+// use up the API rate limit
+const credentialsCheckInterval = 5 * time.Minute
+
+// Ready checks whether the plugin is able to serve config requests: the SCM credentials are accepted by the
+// provider, the allow list file can be parsed and the cache is reachable. The credentials are only checked again
+// after credentialsCheckInterval, until then the last successful check is reused.
+func (p *Plugin) Ready(ctx context.Context) error {
+	if verified := p.credentialsVerified.Load(); verified == 0 || time.Since(time.Unix(0, verified)) > credentialsCheckInterval {
+		if err := p.verifyScmCredentials(ctx); err != nil {
+			return fmt.Errorf("unable to verify SCM credentials: %s", err)
+		}
+		p.credentialsVerified.Store(time.Now().UnixNano())
+	}
+	if err := p.verifyAllowList(); err != nil {
+		return fmt.Errorf("unable to parse allow list file: %s", err)
+	}
+	if err := p.cache.ping(ctx); err != nil {
+		return fmt.Errorf("unable to reach cache: %s", err)
+	}
+	return nil
+}
+
+// verifyScmCredentials sends an authenticated request to the SCM provider
+func (p *Plugin) verifyScmCredentials(ctx context.Context) error {
+	switch p.provider() {
+	case "github":
+		return scm_clients.VerifyGitHubCredentials(ctx, p.server, p.gitHubToken)
+	case "gitlab":
+		return scm_clients.VerifyGitLabCredentials(ctx, p.gitLabServer, p.gitLabToken)
+	case "bitbucket":
+		return scm_clients.VerifyBitBucketCredentials(ctx, p.bitBucketAuthServer, p.bitBucketClient, p.bitBucketSecret)
+	default:
+		return fmt.Errorf("no SCM credentials specified")
+	}
+}
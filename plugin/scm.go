@@ -10,66 +10,96 @@ import (
 	"github.com/drone/drone-go/drone"
 
 	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 )
 
 // NewScmClient creates a new client for the git provider
 func (p *Plugin) NewScmClient(ctx context.Context, uuid uuid.UUID, repo drone.Repo) (scmClient scm_clients.ScmClient, err error) {
-	switch {
-	case p.gitHubToken != "":
+	provider := p.provider()
+	switch provider {
+	case "github":
 		scmClient, err = scm_clients.NewGitHubClient(ctx, uuid, p.server, p.gitHubToken, repo)
-	case p.gitLabToken != "":
+	case "gitlab":
 		scmClient, err = scm_clients.NewGitLabClient(ctx, uuid, p.gitLabServer, p.gitLabToken, repo)
-	case p.bitBucketClient != "":
-		scmClient, err = scm_clients.NewBitBucketClient(uuid, p.bitBucketAuthServer, p.server, p.bitBucketClient, p.bitBucketSecret, repo)
+	case "bitbucket":
+		scmClient, err = scm_clients.NewBitBucketClient(ctx, uuid, p.bitBucketAuthServer, p.server, p.bitBucketClient, p.bitBucketSecret, repo)
 	default:
 		err = fmt.Errorf("no SCM credentials specified")
 	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to SCM server: %s", err)
 	}
-	return
+	scmClient = scm_clients.NewInstrumentedClient(provider, scmClient)
+	scmClient = scm_clients.NewLimitedClient(p.concurrency, scmClient)
+
+	// files are cached in front of the instrumentation and the limit, so only actual SCM calls are recorded and wait
+	if p.scmCache != nil {
+		scmClient = scm_clients.NewCachingClient(p.scmCache, repo.Slug, p.concurrency, scmClient)
+	}
+	return scmClient, nil
+}
+
+// provider returns the name of the SCM provider for the configured credentials
+func (p *Plugin) provider() string {
+	switch {
+	case p.gitHubToken != "":
+		return "github"
+	case p.gitLabToken != "":
+		return "gitlab"
+	case p.bitBucketClient != "":
+		return "bitbucket"
+	default:
+		return ""
+	}
 }
 
 // getChanges tries to get a list of changed files from github
-func (p *Plugin) getScmChanges(ctx context.Context, req *request) ([]string, error) {
-	var changedFiles []string
+func (p *Plugin) getScmChanges(ctx context.Context, req *request) (changedFiles []string, err error) {
+	ctx, span := tracer.Start(ctx, "getScmChanges")
+	defer func() { endSpan(span, err) }()
 
 	if req.Build.Trigger == "@cron" {
 		// cron jobs trigger a full build
 		changedFiles = []string{}
 	} else if strings.HasPrefix(req.Build.Ref, "refs/pull/") {
-		// use pullrequests api to get changed files
-		pullRequestID, err := strconv.Atoi(strings.Split(req.Build.Ref, "/")[2])
+		// use pullrequests api to get changed files. err is not shadowed, so the span records failures
+		var pullRequestID int
+		pullRequestID, err = strconv.Atoi(strings.Split(req.Build.Ref, "/")[2])
 		if err != nil {
-			logrus.Errorf("%s unable to get pull request id %v", req.UUID, err)
+			req.Log.Errorf("unable to get pull request id %v", err)
 			return nil, err
 		}
 		changedFiles, err = req.Client.ChangedFilesInPullRequest(ctx, pullRequestID)
 		if err != nil {
-			logrus.Errorf("%s unable to fetch diff for Pull request %v", req.UUID, err)
+			req.Log.Errorf("unable to fetch diff for Pull request %v", err)
+			return nil, err
 		}
 	} else {
 		// use diff to get changed files
 		before := req.Build.Before
 		after := req.Build.After
+		newBranch := before == "0000000000000000000000000000000000000000" || before == ""
+		branch := strings.TrimPrefix(req.Build.Ref, "refs/heads/")
 
-		// check for broken before
-		if before == "0000000000000000000000000000000000000000" || before == "" {
-			before = fmt.Sprintf("%s~1", after)
+		if newBranch && p.mergeBase && branch != req.Build.Ref && req.Repo.Branch != "" && branch != req.Repo.Branch {
+			// compare a new branch with the default branch, to include all commits of the branch
+			req.Log.Debugf("new branch %s, comparing with %s", branch, req.Repo.Branch)
+			changedFiles, err = req.Client.ChangedFilesSinceMergeBase(ctx, req.Repo.Branch, after)
+		} else {
+			// check for broken before
+			if newBranch {
+				before = fmt.Sprintf("%s~1", after)
+			}
+			changedFiles, err = req.Client.ChangedFilesInDiff(ctx, before, after)
 		}
-
-		var err error
-		changedFiles, err = req.Client.ChangedFilesInDiff(ctx, before, after)
 		if err != nil {
-			logrus.Errorf("%s unable to fetch diff: '%v'", req.UUID, err)
+			req.Log.Errorf("unable to fetch diff: '%v'", err)
 			return nil, err
 		}
 	}
 
 	if len(changedFiles) > 0 {
 		changedList := strings.Join(changedFiles, "\n  ")
-		logrus.Debugf("%s changed files: \n  %s", req.UUID, changedList)
+		req.Log.Debugf("changed files: \n  %s", changedList)
 	} else {
 		return nil, nil
 	}
@@ -78,6 +108,12 @@ func (p *Plugin) getScmChanges(ctx context.Context, req *request) ([]string, err
 
 // getFile downloads a file from github
 func (p *Plugin) getScmFile(ctx context.Context, req *request, file string) (content string, err error) {
-	logrus.Debugf("%s checking %s/%s %s", req.UUID, req.Repo.Namespace, req.Repo.Name, file)
+	req.Log.Debugf("checking %s", file)
 	return req.Client.GetFileContents(ctx, file, req.Build.After)
 }
+
+// getScmFiles downloads multiple files, with a single batch if supported by the SCM
+func (p *Plugin) getScmFiles(ctx context.Context, req *request, files []string) []scm_clients.FileContents {
+	req.Log.Debugf("checking %s", strings.Join(files, ", "))
+	return scm_clients.GetFileContentsBatch(ctx, req.Client, files, req.Build.After, p.concurrency)
+}
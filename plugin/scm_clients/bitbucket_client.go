@@ -10,7 +10,6 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/wbrefvem/go-bitbucket"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path/filepath"
@@ -18,7 +17,7 @@ import (
 )
 
 type BitBucketClient struct {
-	delegate      *bitbucket.APIClient
+	httpClient    *http.Client
 	basePath      string
 	authorization string
 	repo          drone.Repo
@@ -28,154 +27,234 @@ type BitBucketCredentials struct {
 	AccessToken string `json:"access_token"`
 }
 
-func NewBitBucketClient(someUUID uuid.UUID, authServer string, server string,
+func NewBitBucketClient(ctx context.Context, someUUID uuid.UUID, authServer string, server string,
 	clientID string, clientSecret string, repo drone.Repo) (ScmClient, error) {
 
-	form := url.Values{}
-	form.Add("grant_type", "client_credentials")
-	req, err := http.NewRequest("POST", authServer+"/site/oauth2/access_token", strings.NewReader(form.Encode()))
+	httpClient := newHTTPClient("bitbucket")
+	creds, err := getBitBucketCredentials(ctx, httpClient, authServer, clientID, clientSecret)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", "Basic "+basicAuth(clientID, clientSecret))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	response, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	var creds BitBucketCredentials
-	if err = json.NewDecoder(response.Body).Decode(&creds); err != nil && creds.AccessToken != "" {
-		return nil, err
-	}
-	logrus.Infof("%s Authenticated with BitBucket: '%v'", someUUID, authServer)
-
-	authorization := "Bearer " + creds.AccessToken
-	conf := bitbucket.NewConfiguration()
-	conf.Host = server
-	conf.Scheme = "https"
-	conf.AddDefaultHeader("Authorization", authorization)
+	log := logrus.WithFields(logrus.Fields{
+		"request_id": someUUID.String(),
+		"slug":       repo.Slug,
+		"provider":   "bitbucket",
+	})
+	log.Infof("Authenticated with BitBucket: '%v'", authServer)
 
 	basePath := server + "/2.0"
-	client := bitbucket.NewAPIClient(conf)
-	client.ChangeBasePath(basePath)
-	logrus.Infof("%s Created BitBucket API client: '%v'", someUUID, server)
+	log.Infof("Created BitBucket API client: '%v'", server)
 
 	return BitBucketClient{
-		delegate:      client,
+		httpClient:    httpClient,
 		basePath:      basePath,
-		authorization: authorization,
+		authorization: "Bearer " + creds.AccessToken,
 		repo:          repo,
 	}, nil
 }
 
 func (s BitBucketClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
-	var changedFiles []string
-	// Custom implementation because the BitBucket client does not specify the right type
-	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/pullrequests/%v/diffstat",
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/pullrequests/%v/diffstat?pagelen=100",
 		s.basePath, s.repo.Namespace, s.repo.Name, pullRequestID)
-	request, err := http.NewRequest("GET", requestUrl, nil)
-	if err != nil {
-		return []string{}, fmt.Errorf("failed to construct request for pull request %v", pullRequestID)
-	}
-	request.Header.Add("Authorization", s.authorization)
-	response, err := http.DefaultClient.Do(request)
+	return s.listDiffstat(ctx, requestUrl)
+}
 
-	if response == nil || err != nil {
-		return []string{}, fmt.Errorf("failed to get %v: is not a pull request", pullRequestID)
-	}
-	var diffStat bitbucket.PaginatedDiffstats
-	if err = json.NewDecoder(response.Body).Decode(&diffStat); err != nil {
-		return nil, err
-	}
-	for _, fileDiff := range diffStat.Values {
-		if fileDiff.Status == "removed" || fileDiff.Status == "renamed" {
-			changedFiles = append(changedFiles, fileDiff.Old.Path)
+func (s BitBucketClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	// the refs may be tags or branches with a slash, e.g. svc-a/v1.2.3
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/diffstat/%s..%s?pagelen=100",
+		s.basePath, s.repo.Namespace, s.repo.Name, url.PathEscape(base), url.PathEscape(head))
+	return s.listDiffstat(ctx, requestUrl)
+}
+
+func (s BitBucketClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	// the topic diffstat compares the source, the first commit of the spec, with the merge base of both commits
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/diffstat/%s..%s?topic=true&pagelen=100",
+		s.basePath, s.repo.Namespace, s.repo.Name, url.PathEscape(head), url.PathEscape(base))
+	return s.listDiffstat(ctx, requestUrl)
+}
+
+// listDiffstat returns the changed files of all pages of the diffstat, renamed files are listed with their old and
+// new path
+func (s BitBucketClient) listDiffstat(ctx context.Context, requestUrl string) ([]string, error) {
+	var changedFiles []string
+	for requestUrl != "" {
+		var page bitbucket.PaginatedDiffstats
+		if err := s.getJSON(ctx, requestUrl, &page); err != nil {
+			return nil, err
 		}
-		if fileDiff.Status == "modified" || fileDiff.Status == "added" || fileDiff.Status == "renamed" {
-			changedFiles = append(changedFiles, fileDiff.New.Path)
+		for _, fileDiff := range page.Values {
+			if fileDiff.Status == "removed" || fileDiff.Status == "renamed" {
+				changedFiles = append(changedFiles, fileDiff.Old.Path)
+			}
+			if fileDiff.Status == "modified" || fileDiff.Status == "added" || fileDiff.Status == "renamed" {
+				changedFiles = append(changedFiles, fileDiff.New.Path)
+			}
 		}
+		requestUrl = page.Next
 	}
 	return changedFiles, nil
 }
 
-func (s BitBucketClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
-	var changedFiles []string
-	spec := fmt.Sprintf("%s..%s", base, head)
-	diffStat, _, err := s.delegate.DefaultApi.RepositoriesUsernameRepoSlugDiffstatSpecGet(
-		ctx, s.repo.Namespace, s.repo.Name, spec, make(map[string]interface{}))
-	if err != nil {
-		return nil, err
-	}
-	if diffStat.Values == nil {
-		return nil, err
-	}
-	for _, fileDiff := range diffStat.Values {
-		if fileDiff.Status == "removed" || fileDiff.Status == "renamed" {
-			changedFiles = append(changedFiles, fileDiff.Old.Path)
+func (s BitBucketClient) ListTags(ctx context.Context) ([]string, error) {
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/refs/tags?pagelen=100", s.basePath, s.repo.Namespace, s.repo.Name)
+
+	var tags []string
+	for requestUrl != "" {
+		var page bitbucket.PaginatedTags
+		if err := s.getJSON(ctx, requestUrl, &page); err != nil {
+			return nil, err
 		}
-		if fileDiff.Status == "modified" || fileDiff.Status == "added" || fileDiff.Status == "renamed" {
-			changedFiles = append(changedFiles, fileDiff.New.Path)
+		for _, tag := range page.Values {
+			tags = append(tags, tag.Name)
 		}
+		requestUrl = page.Next
 	}
-	return changedFiles, nil
+	return tags, nil
 }
 
 func (s BitBucketClient) GetFileContents(ctx context.Context, path string, commitRef string) (content string, err error) {
 	// Custom implementation because the BitBucket client always tries to deserialize the file as JSON
 	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/src/%v/%v",
 		s.basePath, s.repo.Namespace, s.repo.Name, commitRef, path)
-	request, err := http.NewRequest("GET", requestUrl, nil)
+	response, err := s.get(ctx, requestUrl)
 	if err != nil {
-		return "", fmt.Errorf("failed to construct request for %s", path)
-	}
-	request.Header.Add("Authorization", s.authorization)
-	response, err := http.DefaultClient.Do(request)
-
-	if response == nil || err != nil {
-		return "", fmt.Errorf("failed to get %s: is not a file", path)
-	}
-	if response.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get %s: status code %v", path, response.StatusCode)
+		return "", fmt.Errorf("failed to get %s: %w", path, err)
 	}
+	defer response.Body.Close()
 	bodyBytes, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("failed to get %s: %w", path, err)
 	}
-	bodyString := string(bodyBytes)
-	return bodyString, nil
+	return string(bodyBytes), nil
 }
 
 func (s BitBucketClient) GetFileListing(ctx context.Context, path string, commitRef string) (
 	fileListing []FileListingEntry, err error) {
-	opts := make(map[string]interface{})
-	opts["format"] = "meta"
-	ls, _, err := s.delegate.RepositoriesApi.RepositoriesUsernameRepoSlugSrcNodePathGet(
-		ctx, s.repo.Namespace, commitRef, path+"/", s.repo.Name, opts)
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/src/%v/%v?format=meta&pagelen=100",
+		s.basePath, s.repo.Namespace, s.repo.Name, commitRef, dirPath(path))
+	return s.listSrc(ctx, requestUrl)
+}
+
+func (s BitBucketClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) (
+	fileListing []FileListingEntry, err error) {
+	requestUrl := fmt.Sprintf("%v/repositories/%v/%v/src/%v/%v?max_depth=%d&pagelen=100",
+		s.basePath, s.repo.Namespace, s.repo.Name, commitRef, dirPath(path), maxDepth+1)
+	result, err := s.listSrc(ctx, requestUrl)
+	if err != nil {
+		return nil, err
+	}
+	return limitDepth(result, path, maxDepth), nil
+}
+
+// dirPath returns the path of a directory as expected by the src endpoint, with a trailing slash
+func dirPath(path string) string {
+	dir := strings.Trim(path, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	return dir
+}
 
+// listSrc returns the files and directories of all pages of the src listing
+func (s BitBucketClient) listSrc(ctx context.Context, requestUrl string) ([]FileListingEntry, error) {
 	var result []FileListingEntry
+	for requestUrl != "" {
+		var page bitbucket.PaginatedTreeentries
+		if err := s.getJSON(ctx, requestUrl, &page); err != nil {
+			return nil, err
+		}
+		for _, f := range page.Values {
+			var fileType string
+			if f.Type_ == "commit_file" {
+				fileType = "file"
+			} else if f.Type_ == "commit_directory" {
+				fileType = "dir"
+			} else {
+				continue
+			}
+			fileListingEntry := FileListingEntry{
+				Path: f.Path,
+				Name: filepath.Base(f.Path),
+				Type: fileType,
+			}
+			result = append(result, fileListingEntry)
+		}
+		requestUrl = page.Next
+	}
+	return result, nil
+}
 
+// get sends an authorized GET request to requestUrl. Responses without status 200 are returned as statusError, else
+// the caller has to close the body.
+func (s BitBucketClient) get(ctx context.Context, requestUrl string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Authorization", s.authorization)
+	response, err := s.httpClient.Do(request)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
-
-	for _, f := range ls.Values {
-		var fileType string
-		if f.Type_ == "commit_file" {
-			fileType = "file"
-		} else if f.Type_ == "commit_directory" {
-			fileType = "dir"
-		} else {
-			continue
+	if response.StatusCode != http.StatusOK {
+		drainBody(response)
+		return nil, &statusError{
+			msg:        fmt.Sprintf("failed to get %s: status code %v", requestUrl, response.StatusCode),
+			statusCode: response.StatusCode,
 		}
-		fileName := filepath.Base(f.Path)
-		fileListingEntry := FileListingEntry{
-			Path: f.Path,
-			Name: fileName,
-			Type: fileType,
+	}
+	return response, nil
+}
+
+// getJSON sends an authorized GET request to requestUrl and decodes the json response into v
+func (s BitBucketClient) getJSON(ctx context.Context, requestUrl string, v interface{}) error {
+	response, err := s.get(ctx, requestUrl)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// VerifyBitBucketCredentials checks that an access token can be obtained with the client credentials
+func VerifyBitBucketCredentials(ctx context.Context, authServer string, clientID string, clientSecret string) error {
+	creds, err := getBitBucketCredentials(ctx, newHTTPClient("bitbucket"), authServer, clientID, clientSecret)
+	if err != nil {
+		return err
+	}
+	if creds.AccessToken == "" {
+		return fmt.Errorf("no access token received from %s", authServer)
+	}
+	return nil
+}
+
+// getBitBucketCredentials requests an access token for the client credentials
+func getBitBucketCredentials(ctx context.Context, httpClient *http.Client, authServer string, clientID string,
+	clientSecret string) (*BitBucketCredentials, error) {
+	form := url.Values{}
+	form.Add("grant_type", "client_credentials")
+	req, err := http.NewRequestWithContext(ctx, "POST", authServer+"/site/oauth2/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Basic "+basicAuth(clientID, clientSecret))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{
+			msg:        fmt.Sprintf("failed to authenticate with %s: status code %v", authServer, response.StatusCode),
+			statusCode: response.StatusCode,
 		}
-		result = append(result, fileListingEntry)
 	}
-	return result, err
+	var creds BitBucketCredentials
+	if err = json.NewDecoder(response.Body).Decode(&creds); err != nil {
+		return nil, err
+	}
+	return &creds, nil
 }
 
 func basicAuth(username string, password string) string {
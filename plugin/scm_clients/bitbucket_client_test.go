@@ -1,6 +1,9 @@
 package scm_clients
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/drone/drone-go/drone"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -8,6 +11,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -36,6 +41,47 @@ func TestBitBucket_ChangedFilesInDiff(t *testing.T) {
 	BaseTest_ChangedFilesInDiff(t, client)
 }
 
+func TestBitBucket_ChangedFilesSinceMergeBase(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ChangedFilesSinceMergeBase(t, client)
+}
+
+func TestBitBucket_PrefixedTag(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the slash of the tag is escaped, so it stays part of the spec
+	changedFiles, err := client.ChangedFilesInDiff(noContext, "svc-a/v1.2.2", "8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"a/.drone.yml"}, changedFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestBitBucket_ListTags(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ListTags(t, client)
+}
+
 func TestBitBucket_ChangedFilesInPullRequest(t *testing.T) {
 	ts := httptest.NewServer(testMuxBitBucket())
 	defer ts.Close()
@@ -48,6 +94,54 @@ func TestBitBucket_ChangedFilesInPullRequest(t *testing.T) {
 	BaseTest_ChangedFilesInPullRequest(t, client)
 }
 
+func TestBitBucket_Paginated(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	actualFiles, err := client.ChangedFilesInPullRequest(noContext, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"a/.drone.yml", "b/old", "b/new", "c/deleted"}, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %q got %q", want, got)
+	}
+
+	listing, err := client.GetFileListing(noContext, "paged", "8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedListing := []FileListingEntry{
+		{Type: "file", Path: "paged/.drone.yml", Name: ".drone.yml"},
+		{Type: "dir", Path: "paged/sub", Name: "sub"},
+	}
+	if want, got := expectedListing, listing; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %v got %v", want, got)
+	}
+}
+
+func TestBitBucket_StatusCode(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// error responses are reported by their status instead of being decoded
+	if _, err := client.ChangedFilesInPullRequest(noContext, 5); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("Want not found error got %v", err)
+	}
+	if _, err := client.GetFileContents(noContext, "missing/.drone.yml", "8ecad91991d5da985a2a8dd97cc19029dc1c2899"); Classify(err) != ErrorNotFound {
+		t.Errorf("Want not found error got %v", err)
+	}
+}
+
 func TestBitBucket_GetFileListing(t *testing.T) {
 	ts := httptest.NewServer(testMuxBitBucket())
 	defer ts.Close()
@@ -60,13 +154,40 @@ func TestBitBucket_GetFileListing(t *testing.T) {
 	BaseTest_GetFileListing(t, client)
 }
 
+func TestBitBucket_GetFileTree(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	client, err := createBitBucketClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	BaseTest_GetFileTree(t, client)
+}
+
+func TestBitBucket_CanceledAuthentication(t *testing.T) {
+	ts := httptest.NewServer(testMuxBitBucket())
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(noContext)
+	cancel()
+
+	repo := drone.Repo{Namespace: "foosinn", Name: "dronetest", Slug: "foosinn/dronetest"}
+	if _, err := NewBitBucketClient(ctx, uuid.New(), ts.URL, ts.URL, mockClientId, mockSecret, repo); !errors.Is(err, context.Canceled) {
+		t.Errorf("Want %v got %v", context.Canceled, err)
+	}
+	if err := VerifyBitBucketCredentials(ctx, ts.URL, mockClientId, mockSecret); !errors.Is(err, context.Canceled) {
+		t.Errorf("Want %v got %v", context.Canceled, err)
+	}
+}
+
 func createBitBucketClient(server string) (ScmClient, error) {
 	repo := drone.Repo{
 		Namespace: "foosinn",
 		Name:      "dronetest",
 		Slug:      "foosinn/dronetest",
 	}
-	return NewBitBucketClient(uuid.New(), server, server, mockClientId, mockSecret, repo)
+	return NewBitBucketClient(noContext, uuid.New(), server, server, mockClientId, mockSecret, repo)
 }
 
 func testMuxBitBucket() *http.ServeMux {
@@ -81,11 +202,50 @@ func testMuxBitBucket() *http.ServeMux {
 			f, _ := os.Open("../testdata/bitbucket/compare.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/diffstat/8ecad91991d5da985a2a8dd97cc19029dc1c2899..master",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("topic") == "true" {
+				f, _ := os.Open("../testdata/bitbucket/compare.json")
+				_, _ = io.Copy(w, f)
+			}
+		})
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/diffstat/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != "/2.0/repositories/foosinn/dronetest/diffstat/svc-a%2Fv1.2.2..8ecad91991d5da985a2a8dd97cc19029dc1c2899" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			bitbucketPages([]map[string]interface{}{
+				{"status": "modified", "old": map[string]string{"path": "a/.drone.yml"}, "new": map[string]string{"path": "a/.drone.yml"}},
+			})(w, r)
+		})
 	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/pullrequests/3/diffstat",
 		func(w http.ResponseWriter, r *http.Request) {
 			f, _ := os.Open("../testdata/bitbucket/pull_3_files.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/refs/tags",
+		bitbucketPages([]map[string]interface{}{{"name": "v1.0.0"}, {"name": "v1.1.0"}}))
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/pullrequests/4/diffstat",
+		bitbucketPages([]map[string]interface{}{
+			{"status": "modified", "old": map[string]string{"path": "a/.drone.yml"}, "new": map[string]string{"path": "a/.drone.yml"}},
+			{"status": "renamed", "old": map[string]string{"path": "b/old"}, "new": map[string]string{"path": "b/new"}},
+			{"status": "removed", "old": map[string]string{"path": "c/deleted"}},
+		}))
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/pullrequests/5/diffstat",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"type": "error", "error": {"message": "Pull request not found"}}`)
+		})
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/src/8ecad91991d5da985a2a8dd97cc19029dc1c2899/missing/.drone.yml",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})
+	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/src/8ecad91991d5da985a2a8dd97cc19029dc1c2899/paged/",
+		bitbucketPages([]map[string]interface{}{
+			{"type": "commit_file", "path": "paged/.drone.yml"},
+			{"type": "commit_directory", "path": "paged/sub"},
+		}))
 	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/src/8ecad91991d5da985a2a8dd97cc19029dc1c2899/afolder/.drone.yml",
 		func(w http.ResponseWriter, r *http.Request) {
 			f, _ := os.Open("../testdata/bitbucket/afolder_.drone.yml")
@@ -93,6 +253,11 @@ func testMuxBitBucket() *http.ServeMux {
 		})
 	mux.HandleFunc("/2.0/repositories/foosinn/dronetest/src/8ecad91991d5da985a2a8dd97cc19029dc1c2899/afolder/",
 		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("max_depth") == "2" {
+				f, _ := os.Open("../testdata/bitbucket/tree.json")
+				_, _ = io.Copy(w, f)
+				return
+			}
 			f, _ := os.Open("../testdata/bitbucket/afolder.json")
 			_, _ = io.Copy(w, f)
 		})
@@ -101,3 +266,27 @@ func testMuxBitBucket() *http.ServeMux {
 	})
 	return mux
 }
+
+// bitbucketPages serves the values with one value per page, linked by next
+func bitbucketPages(values []map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		if page < 1 {
+			page = 1
+		}
+		response := map[string]interface{}{
+			"pagelen": 1,
+			"values":  values[page-1 : page],
+		}
+		if page < len(values) {
+			next := *r.URL
+			next.Scheme = "http"
+			next.Host = r.Host
+			query := next.Query()
+			query.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = query.Encode()
+			response["next"] = next.String()
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}
+}
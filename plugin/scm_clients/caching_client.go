@@ -0,0 +1,241 @@
+package scm_clients
+
+import (
+	"container/list"
+	"context"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// commitSHA matches full sha1 and sha256 commit ids, which always reference the same content
+var commitSHA = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// IsCommitSHA returns true if ref is a full commit id, which always references the same content
+func IsCommitSHA(ref string) bool {
+	return commitSHA.MatchString(ref)
+}
+
+// fileCacheKey identifies the result of a GetFileContents or GetFileListing call
+type fileCacheKey struct {
+	method    string
+	repo      string
+	commitRef string
+	path      string
+	maxDepth  int
+}
+
+// fileCacheEntry holds the result of a GetFileContents or GetFileListing call. Failed calls are only cached if the
+// file was not found, these entries expire.
+type fileCacheEntry struct {
+	key         fileCacheKey
+	content     string
+	fileListing []FileListingEntry
+	err         error
+	expires     time.Time
+}
+
+// size estimates the memory used by the entry in bytes
+func (e *fileCacheEntry) size() int64 {
+	size := len(e.key.method) + len(e.key.repo) + len(e.key.commitRef) + len(e.key.path) + len(e.content)
+	for _, f := range e.fileListing {
+		size += len(f.Type) + len(f.Name) + len(f.Path)
+	}
+	if e.err != nil {
+		size += len(e.err.Error())
+	}
+	return int64(size)
+}
+
+// FileCache holds file contents and listings by commit. As commits are immutable the entries never expire, they are
+// only evicted once maxBytes is reached. Files which were not found are cached for notFoundTTL, as a missing
+// permission may also be reported as not found. A FileCache is safe for concurrent use and can be shared by all clients.
+type FileCache struct {
+	maxBytes    int64
+	notFoundTTL time.Duration
+
+	lock    sync.Mutex
+	entries map[fileCacheKey]*list.Element
+	lru     list.List
+	bytes   int64
+}
+
+// NewFileCache creates a FileCache which holds up to maxBytes. Files which were not found are cached for notFoundTTL,
+// 0 disables caching them.
+func NewFileCache(maxBytes int64, notFoundTTL time.Duration) *FileCache {
+	return &FileCache{
+		maxBytes:    maxBytes,
+		notFoundTTL: notFoundTTL,
+		entries:     make(map[fileCacheKey]*list.Element),
+	}
+}
+
+func (c *FileCache) get(key fileCacheKey) (*fileCacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exists := c.entries[key]
+	if exists {
+		if entry := element.Value.(*fileCacheEntry); !entry.expires.IsZero() && time.Now().After(entry.expires) {
+			c.remove(element)
+			scmCacheBytes.Set(float64(c.bytes))
+			exists = false
+		}
+	}
+	if !exists {
+		scmCacheOperationsTotal.WithLabelValues(key.method, "miss").Inc()
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	scmCacheOperationsTotal.WithLabelValues(key.method, "hit").Inc()
+	return element.Value.(*fileCacheEntry), true
+}
+
+func (c *FileCache) add(entry *fileCacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exists := c.entries[entry.key]; exists {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+
+	// evict the least recently used entries until the limit is satisfied
+	for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		evicted := c.remove(c.lru.Back())
+		scmCacheOperationsTotal.WithLabelValues(evicted.key.method, "evict").Inc()
+	}
+	scmCacheBytes.Set(float64(c.bytes))
+}
+
+// addResult caches the result of a call. Failed calls are only cached if the file was not found.
+func (c *FileCache) addResult(entry *fileCacheEntry) {
+	if entry.err != nil {
+		if c.notFoundTTL <= 0 || Classify(entry.err) != ErrorNotFound {
+			return
+		}
+		entry.expires = time.Now().Add(c.notFoundTTL)
+	}
+	c.add(entry)
+}
+
+// remove deletes the element from the cache and returns its entry. The caller must hold the lock.
+func (c *FileCache) remove(element *list.Element) *fileCacheEntry {
+	entry := c.lru.Remove(element).(*fileCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+	return entry
+}
+
+// cachingClient serves GetFileContents, GetFileListing and GetFileTree calls for commit ids from a FileCache
+type cachingClient struct {
+	delegate ScmClient
+	cache    *FileCache
+	repo     string
+	workers  int
+}
+
+// NewCachingClient wraps the client to cache the files and listings of repo. Only calls with a full commit id are
+// cached, all other calls are passed to the client. Missing files which can not be fetched with a batch are fetched by
+// at most workers concurrent calls.
+func NewCachingClient(cache *FileCache, repo string, workers int, client ScmClient) ScmClient {
+	return cachingClient{
+		delegate: client,
+		cache:    cache,
+		repo:     repo,
+		workers:  workers,
+	}
+}
+
+func (s cachingClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
+	return s.delegate.ChangedFilesInPullRequest(ctx, pullRequestID)
+}
+
+func (s cachingClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	return s.delegate.ChangedFilesInDiff(ctx, base, head)
+}
+
+func (s cachingClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	return s.delegate.ChangedFilesSinceMergeBase(ctx, base, head)
+}
+
+func (s cachingClient) ListTags(ctx context.Context) ([]string, error) {
+	return s.delegate.ListTags(ctx)
+}
+
+func (s cachingClient) GetFileContents(ctx context.Context, path string, commitRef string) (string, error) {
+	if !commitSHA.MatchString(commitRef) {
+		return s.delegate.GetFileContents(ctx, path, commitRef)
+	}
+
+	key := fileCacheKey{method: "GetFileContents", repo: s.repo, commitRef: commitRef, path: path}
+	if entry, ok := s.cache.get(key); ok {
+		return entry.content, entry.err
+	}
+	content, err := s.delegate.GetFileContents(ctx, path, commitRef)
+	s.cache.addResult(&fileCacheEntry{key: key, content: content, err: err})
+	return content, err
+}
+
+// GetFileContentsBatch serves the cached files and fetches the others with a single batch, if supported by the delegate
+func (s cachingClient) GetFileContentsBatch(ctx context.Context, paths []string, commitRef string) ([]FileContents, error) {
+	if !commitSHA.MatchString(commitRef) {
+		return GetFileContentsBatch(ctx, s.delegate, paths, commitRef, s.workers), nil
+	}
+
+	contents := make([]FileContents, len(paths))
+	var missing []int
+	var missingPaths []string
+	for i, path := range paths {
+		key := fileCacheKey{method: "GetFileContents", repo: s.repo, commitRef: commitRef, path: path}
+		if entry, ok := s.cache.get(key); ok {
+			contents[i] = FileContents{Content: entry.content, Err: entry.err}
+			continue
+		}
+		missing = append(missing, i)
+		missingPaths = append(missingPaths, path)
+	}
+
+	fetched := GetFileContentsBatch(ctx, s.delegate, missingPaths, commitRef, s.workers)
+	for j, i := range missing {
+		contents[i] = fetched[j]
+		key := fileCacheKey{method: "GetFileContents", repo: s.repo, commitRef: commitRef, path: paths[i]}
+		s.cache.addResult(&fileCacheEntry{key: key, content: fetched[j].Content, err: fetched[j].Err})
+	}
+	return contents, nil
+}
+
+func (s cachingClient) GetFileListing(ctx context.Context, path string, commitRef string) ([]FileListingEntry, error) {
+	if !commitSHA.MatchString(commitRef) {
+		return s.delegate.GetFileListing(ctx, path, commitRef)
+	}
+
+	key := fileCacheKey{method: "GetFileListing", repo: s.repo, commitRef: commitRef, path: path}
+	if entry, ok := s.cache.get(key); ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return append([]FileListingEntry(nil), entry.fileListing...), nil
+	}
+	fileListing, err := s.delegate.GetFileListing(ctx, path, commitRef)
+	s.cache.addResult(&fileCacheEntry{key: key, fileListing: append([]FileListingEntry(nil), fileListing...), err: err})
+	return fileListing, err
+}
+
+func (s cachingClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) ([]FileListingEntry, error) {
+	if !commitSHA.MatchString(commitRef) {
+		return s.delegate.GetFileTree(ctx, path, commitRef, maxDepth)
+	}
+
+	key := fileCacheKey{method: "GetFileTree", repo: s.repo, commitRef: commitRef, path: path, maxDepth: maxDepth}
+	if entry, ok := s.cache.get(key); ok {
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return append([]FileListingEntry(nil), entry.fileListing...), nil
+	}
+	fileListing, err := s.delegate.GetFileTree(ctx, path, commitRef, maxDepth)
+	s.cache.addResult(&fileCacheEntry{key: key, fileListing: append([]FileListingEntry(nil), fileListing...), err: err})
+	return fileListing, err
+}
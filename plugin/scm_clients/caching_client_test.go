@@ -0,0 +1,187 @@
+package scm_clients
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingClient returns fixed results and counts the calls per method
+type countingClient struct {
+	calls map[string]int
+	err   error
+}
+
+func (c *countingClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
+	c.calls["ChangedFilesInPullRequest"]++
+	return []string{"a/.drone.yml"}, c.err
+}
+
+func (c *countingClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	c.calls["ChangedFilesInDiff"]++
+	return []string{"a/.drone.yml"}, c.err
+}
+
+func (c *countingClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	c.calls["ChangedFilesSinceMergeBase"]++
+	return []string{"a/.drone.yml"}, c.err
+}
+
+func (c *countingClient) ListTags(ctx context.Context) ([]string, error) {
+	c.calls["ListTags"]++
+	return []string{"v1.0.0"}, c.err
+}
+
+func (c *countingClient) GetFileContents(ctx context.Context, path string, commitRef string) (string, error) {
+	c.calls["GetFileContents"]++
+	return path + "@" + commitRef, c.err
+}
+
+func (c *countingClient) GetFileListing(ctx context.Context, path string, commitRef string) ([]FileListingEntry, error) {
+	c.calls["GetFileListing"]++
+	return []FileListingEntry{{Type: "file", Name: ".drone.yml", Path: path + "/.drone.yml"}}, c.err
+}
+
+func (c *countingClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) ([]FileListingEntry, error) {
+	c.calls["GetFileTree"]++
+	return []FileListingEntry{{Type: "file", Name: ".drone.yml", Path: path + "/.drone.yml"}}, c.err
+}
+
+func TestCachingClient(t *testing.T) {
+	const sha = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	delegate := &countingClient{calls: map[string]int{}}
+	cache := NewFileCache(1<<20, time.Hour)
+	client := NewCachingClient(cache, "foosinn/dronetest", 1, delegate)
+
+	// commit ids are cached
+	for i := 0; i < 2; i++ {
+		content, err := client.GetFileContents(noContext, "a/.drone.yml", sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "a/.drone.yml@"+sha, content; want != got {
+			t.Errorf("Want %q got %q", want, got)
+		}
+		listing, err := client.GetFileListing(noContext, "a", sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := []FileListingEntry{{Type: "file", Name: ".drone.yml", Path: "a/.drone.yml"}}, listing; !reflect.DeepEqual(want, got) {
+			t.Errorf("Want %v got %v", want, got)
+		}
+	}
+
+	// entries are shared between clients of the same repo, but not between repos
+	_, _ = NewCachingClient(cache, "foosinn/dronetest", 1, delegate).GetFileContents(noContext, "a/.drone.yml", sha)
+	_, _ = NewCachingClient(cache, "foosinn/other", 1, delegate).GetFileContents(noContext, "a/.drone.yml", sha)
+
+	// branch names and errors are not cached
+	for i := 0; i < 2; i++ {
+		_, _ = client.GetFileContents(noContext, "a/.drone.yml", "master")
+	}
+	delegate.err = errors.New("not found")
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetFileContents(noContext, "b/.drone.yml", sha); err == nil {
+			t.Error("Want error")
+		}
+	}
+
+	// other calls are passed through
+	_, _ = client.ChangedFilesInDiff(noContext, sha, sha)
+
+	want := map[string]int{"GetFileContents": 6, "GetFileListing": 1, "ChangedFilesInDiff": 1}
+	if got := delegate.calls; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want calls %v got %v", want, got)
+	}
+}
+
+func TestCachingClient_NotFound(t *testing.T) {
+	const sha = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	delegate := &countingClient{calls: map[string]int{}}
+	cache := NewFileCache(1<<20, time.Hour)
+	client := NewCachingClient(cache, "foosinn/dronetest", 1, delegate)
+
+	// files which do not exist are cached, including the error
+	delegate.err = &statusError{msg: "not found", statusCode: 404}
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetFileContents(noContext, "a/.drone.yml", sha); StatusCode(err) != 404 {
+			t.Errorf("Want not found error got %v", err)
+		}
+	}
+
+	// transient errors are not cached
+	delegate.err = &statusError{msg: "bad gateway", statusCode: 502}
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetFileContents(noContext, "b/.drone.yml", sha); err == nil {
+			t.Error("Want error")
+		}
+	}
+	if want, got := 3, delegate.calls["GetFileContents"]; want != got {
+		t.Errorf("Want %d calls got %d", want, got)
+	}
+
+	// not found entries expire
+	key := fileCacheKey{method: "GetFileContents", repo: "foosinn/dronetest", commitRef: sha, path: "a/.drone.yml"}
+	cache.entries[key].Value.(*fileCacheEntry).expires = time.Now().Add(-time.Second)
+	delegate.err = nil
+	if content, err := client.GetFileContents(noContext, "a/.drone.yml", sha); err != nil || content == "" {
+		t.Errorf("Want content got %q %v", content, err)
+	}
+}
+
+func TestCachingClient_Batch(t *testing.T) {
+	const sha = "8ecad91991d5da985a2a8dd97cc19029dc1c2899"
+	delegate := &countingClient{calls: map[string]int{}}
+	cache := NewFileCache(1<<20, time.Hour)
+
+	// the counting client does not support batches, so the missing files are fetched one by one
+	client := NewCachingClient(cache, "foosinn/dronetest", 1, NewLimitedClient(1, delegate))
+	_, _ = client.GetFileContents(noContext, "a/.drone.yml", sha)
+
+	paths := []string{"a/.drone.yml", "b/.drone.yml", "c/.drone.yml"}
+	for i := 0; i < 2; i++ {
+		contents := GetFileContentsBatch(noContext, client, paths, sha, 1)
+		for j, path := range paths {
+			if want, got := (FileContents{Content: path + "@" + sha}), contents[j]; want != got {
+				t.Errorf("Want %v got %v", want, got)
+			}
+		}
+	}
+	if want, got := 3, delegate.calls["GetFileContents"]; want != got {
+		t.Errorf("Want %d calls got %d", want, got)
+	}
+}
+
+func TestFileCache_Evict(t *testing.T) {
+	cache := NewFileCache(100, time.Hour)
+	keys := []fileCacheKey{
+		{method: "GetFileListing", repo: "a", commitRef: "1", path: "a"},
+		{method: "GetFileContents", repo: "a", commitRef: "1", path: "b"},
+	}
+	listingsBefore := testutil.ToFloat64(scmCacheOperationsTotal.WithLabelValues("GetFileListing", "evict"))
+	contentsBefore := testutil.ToFloat64(scmCacheOperationsTotal.WithLabelValues("GetFileContents", "evict"))
+	cache.add(&fileCacheEntry{key: keys[0], content: string(make([]byte, 60))})
+	cache.add(&fileCacheEntry{key: keys[1], content: string(make([]byte, 60))})
+
+	// the eviction is counted for the method of the evicted entry
+	if want, got := listingsBefore+1, testutil.ToFloat64(scmCacheOperationsTotal.WithLabelValues("GetFileListing", "evict")); want != got {
+		t.Errorf("Want %v evicted listings got %v", want, got)
+	}
+	if want, got := contentsBefore, testutil.ToFloat64(scmCacheOperationsTotal.WithLabelValues("GetFileContents", "evict")); want != got {
+		t.Errorf("Want %v evicted files got %v", want, got)
+	}
+
+	if _, ok := cache.get(keys[0]); ok {
+		t.Error("entry a still in cache")
+	}
+	if _, ok := cache.get(keys[1]); !ok {
+		t.Error("entry b not in cache")
+	}
+	if want, got := int64(78), cache.bytes; want != got {
+		t.Errorf("Want %d bytes got %d", want, got)
+	}
+}
@@ -0,0 +1,102 @@
+package scm_clients
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// ErrNotAFile is returned when the requested path exists, but is not a file
+var ErrNotAFile = errors.New("is not a file")
+
+// ErrTreeTruncated is returned when the provider did not return the complete file tree
+var ErrTreeTruncated = errors.New("file tree truncated")
+
+// statusError is returned by requests which are sent without a provider sdk
+type statusError struct {
+	msg        string
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// StatusCode returns the http status code of a failed SCM request. It returns 0 when the status is unknown.
+func StatusCode(err error) int {
+	var resp *http.Response
+
+	var ghErr *github.ErrorResponse
+	var ghRateErr *github.RateLimitError
+	var ghAbuseErr *github.AbuseRateLimitError
+	var glErr *gitlab.ErrorResponse
+	var sErr *statusError
+	switch {
+	case errors.As(err, &ghErr):
+		resp = ghErr.Response
+	case errors.As(err, &ghRateErr):
+		resp = ghRateErr.Response
+	case errors.As(err, &ghAbuseErr):
+		resp = ghAbuseErr.Response
+	case errors.As(err, &glErr):
+		resp = glErr.Response
+	case errors.As(err, &sErr):
+		return sErr.statusCode
+	}
+
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// ErrorClass describes whether a failed request is expected to fail again
+type ErrorClass int
+
+const (
+	// ErrorTransient failures, e.g. server errors, rate limits or timeouts, may succeed when retried
+	ErrorTransient ErrorClass = iota
+	// ErrorNotFound failures reference a repository, commit or file which does not exist
+	ErrorNotFound
+	// ErrorPermanent failures, e.g. invalid requests or configs, will fail again when retried
+	ErrorPermanent
+	// ErrorUnauthorized failures were rejected because of the credentials, e.g. an expired token or missing
+	// permissions. They will fail again until the credentials or permissions are changed.
+	ErrorUnauthorized
+	// ErrorUnknown failures have neither a status code nor a known cause, they may or may not fail again
+	ErrorUnknown
+)
+
+// Classify returns the ErrorClass of err. Errors without a status code are considered transient if they were caused
+// by the network or a context, all others are unknown.
+func Classify(err error) ErrorClass {
+	var ghRateErr *github.RateLimitError
+	var ghAbuseErr *github.AbuseRateLimitError
+	switch {
+	case errors.As(err, &ghRateErr) || errors.As(err, &ghAbuseErr):
+		return ErrorTransient
+	case errors.Is(err, ErrNotAFile):
+		return ErrorNotFound
+	}
+
+	switch statusCode := StatusCode(err); {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return ErrorNotFound
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return ErrorTransient
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorUnauthorized
+	case statusCode != 0:
+		return ErrorPermanent
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.As(err, &netErr) {
+		return ErrorTransient
+	}
+	return ErrorUnknown
+}
@@ -0,0 +1,46 @@
+package scm_clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v33/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestClassify(t *testing.T) {
+	response := func(statusCode int) *http.Response {
+		return &http.Response{StatusCode: statusCode, Request: &http.Request{Method: "GET", URL: &url.URL{}}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"GithubNotFound", &github.ErrorResponse{Response: response(404)}, ErrorNotFound},
+		{"GithubBadGateway", &github.ErrorResponse{Response: response(502)}, ErrorTransient},
+		{"GithubUnauthorized", &github.ErrorResponse{Response: response(401)}, ErrorUnauthorized},
+		{"GithubRateLimit", &github.RateLimitError{Response: response(403)}, ErrorTransient},
+		{"GithubAbuseRateLimit", &github.AbuseRateLimitError{Response: response(403)}, ErrorTransient},
+		{"GithubUnprocessable", &github.ErrorResponse{Response: response(422)}, ErrorPermanent},
+		{"GitlabNotFound", &gitlab.ErrorResponse{Response: response(404)}, ErrorNotFound},
+		{"GitlabTooManyRequests", &gitlab.ErrorResponse{Response: response(429)}, ErrorTransient},
+		{"StatusError", &statusError{msg: "gone", statusCode: 410}, ErrorNotFound},
+		{"NotAFile", fmt.Errorf("failed to get a: %w", ErrNotAFile), ErrorNotFound},
+		{"Deadline", fmt.Errorf("failed: %w", context.DeadlineExceeded), ErrorTransient},
+		{"Network", &url.Error{Op: "Get", URL: "http://localhost", Err: errors.New("connection refused")}, ErrorTransient},
+		{"Other", errors.New("unexpected EOF"), ErrorUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Classify(test.err); test.want != got {
+				t.Errorf("Want %v got %v", test.want, got)
+			}
+		})
+	}
+}
@@ -3,6 +3,10 @@ package scm_clients
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/drone/drone-go/drone"
@@ -12,9 +16,17 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	// githubCompareMaxFiles is the maximum number of files listed by the compare api
+	githubCompareMaxFiles = 300
+	// githubBatchSize is the maximum number of files which are requested with a single GraphQL query
+	githubBatchSize = 100
+)
+
 type GithubClient struct {
 	delegate *github.Client
 	repo     drone.Repo
+	log      *logrus.Entry
 }
 
 var (
@@ -24,18 +36,35 @@ var (
 
 // NewGitHubClient creates a GithubClient which can be used to send requests to the Github API
 func NewGitHubClient(ctx context.Context, uuid uuid.UUID, server string, token string, repo drone.Repo) (ScmClient, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"request_id": uuid.String(),
+		"slug":       repo.Slug,
+		"provider":   "github",
+	})
 	client, err := getClientDelegate(ctx, server, token)
 	if err != nil {
-		logrus.Errorf("%s Unable to connect to Github: '%v'", uuid, err)
+		log.Errorf("Unable to connect to Github: '%v'", err)
 		return nil, err
 	}
 
 	return GithubClient{
 		delegate: client,
 		repo:     repo,
+		log:      log,
 	}, nil
 }
 
+// VerifyGitHubCredentials checks that the token is accepted by the Github API. The rate limit endpoint is used, as
+// it does not count against the rate limit.
+func VerifyGitHubCredentials(ctx context.Context, server string, token string) error {
+	client, err := getClientDelegate(ctx, server, token)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.RateLimits(ctx)
+	return err
+}
+
 func getClientDelegate(ctx context.Context, server string, token string) (*github.Client, error) {
 	lock.Lock()
 	defer lock.Unlock()
@@ -46,9 +75,10 @@ func getClientDelegate(ctx context.Context, server string, token string) (*githu
 	}
 
 	// create a new one
-	trans := oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: token},
-	))
+	trans := &http.Client{Transport: &oauth2.Transport{
+		Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+		Base:   newRetryTransport("github", http.DefaultTransport),
+	}}
 	if server == "" {
 		ghClient = github.NewClient(trans)
 	} else {
@@ -89,16 +119,90 @@ func (s GithubClient) ChangedFilesInDiff(ctx context.Context, base string, head
 	if err != nil {
 		return nil, err
 	}
+
+	// the compare api lists at most githubCompareMaxFiles files, even when paginated
+	if len(changes.Files) >= githubCompareMaxFiles {
+		s.log.Warnf("compare of %s...%s lists %d files and may be truncated, comparing the trees instead",
+			base, head, len(changes.Files))
+		if mergeBase := changes.GetMergeBaseCommit().GetSHA(); mergeBase != "" {
+			base = mergeBase
+		}
+		return s.diffTrees(ctx, base, head)
+	}
+
 	for _, file := range changes.Files {
 		changedFiles = append(changedFiles, *file.Filename)
 	}
 	return changedFiles, nil
 }
 
+// ChangedFilesSinceMergeBase is the same as ChangedFilesInDiff, as the compare api always diffs against the merge base
+func (s GithubClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	return s.ChangedFilesInDiff(ctx, base, head)
+}
+
+func (s GithubClient) ListTags(ctx context.Context) ([]string, error) {
+	var tags []string
+	opts := &github.ListOptions{PerPage: 100}
+
+	for {
+		page, resp, err := s.delegate.Repositories.ListTags(ctx, s.repo.Namespace, s.repo.Name, opts)
+		if resp != nil && resp.Request != nil && resp.Request.URL != nil {
+			s.log.Debugf("Repositories.ListTags %d: %s", resp.StatusCode, resp.Request.URL)
+		} else {
+			s.log.Debugf("Repositories.ListTags <nil> response encountered, err: %s", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range page {
+			tags = append(tags, tag.GetName())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return tags, nil
+}
+
+// diffTrees returns the files which differ between the recursive trees of the commits base and head
+func (s GithubClient) diffTrees(ctx context.Context, base string, head string) ([]string, error) {
+	baseFiles, err := s.treeFiles(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	headFiles, err := s.treeFiles(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffFiles(baseFiles, headFiles), nil
+}
+
+// treeFiles returns the object sha of every file and submodule in the recursive tree of the commit
+func (s GithubClient) treeFiles(ctx context.Context, commitRef string) (map[string]string, error) {
+	tree, _, err := s.getTree(ctx, commitRef)
+	if err != nil {
+		return nil, err
+	}
+	if tree.GetTruncated() {
+		return nil, fmt.Errorf("failed to list the files of %s: %w", commitRef, ErrTreeTruncated)
+	}
+
+	files := make(map[string]string, len(tree.Entries))
+	for _, f := range tree.Entries {
+		if f.GetType() == "blob" || f.GetType() == "commit" {
+			files[f.GetPath()] = f.GetSHA()
+		}
+	}
+	return files, nil
+}
+
 func (s GithubClient) GetFileContents(ctx context.Context, path string, commitRef string) (content string, err error) {
 	data, _, _, err := s.getContents(ctx, path, commitRef)
-	if data == nil {
-		err = fmt.Errorf("failed to get %s: is not a file", path)
+	if err == nil && data == nil {
+		err = fmt.Errorf("failed to get %s: %w", path, ErrNotAFile)
 	}
 	if err != nil {
 		return "", err
@@ -106,6 +210,110 @@ func (s GithubClient) GetFileContents(ctx context.Context, path string, commitRe
 	return data.GetContent()
 }
 
+// GetFileContentsBatch fetches the files with GraphQL queries of up to githubBatchSize files. Binary files and files
+// which are too large for GraphQL are fetched with GetFileContents.
+func (s GithubClient) GetFileContentsBatch(ctx context.Context, paths []string, commitRef string) (
+	contents []FileContents, err error) {
+	contents = make([]FileContents, 0, len(paths))
+	for start := 0; start < len(paths); start += githubBatchSize {
+		end := start + githubBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		batch, err := s.getBlobs(ctx, paths[start:end], commitRef)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, batch...)
+	}
+	return contents, nil
+}
+
+// githubObject is a git object returned by the GraphQL object field, only blobs have a text
+type githubObject struct {
+	Typename    string  `json:"__typename"`
+	Text        *string `json:"text"`
+	IsBinary    bool    `json:"isBinary"`
+	IsTruncated bool    `json:"isTruncated"`
+}
+
+// githubGraphqlURL returns the GraphQL endpoint for the REST api at baseURL. On github.com it is
+// https://api.github.com/graphql, on Github Enterprise it is next to the REST api, e.g. /api/graphql for /api/v3/.
+func githubGraphqlURL(baseURL *url.URL) string {
+	graphql := &url.URL{Path: "../graphql"}
+	if baseURL.Host == "api.github.com" {
+		graphql.Path = "/graphql"
+	}
+	return baseURL.ResolveReference(graphql).String()
+}
+
+// getBlobs fetches the files with a single GraphQL query, each file is requested by an aliased object field
+func (s GithubClient) getBlobs(ctx context.Context, paths []string, commitRef string) ([]FileContents, error) {
+	var params, fields []string
+	variables := map[string]interface{}{
+		"owner": s.repo.Namespace,
+		"name":  s.repo.Name,
+	}
+	for i, path := range paths {
+		params = append(params, fmt.Sprintf("$e%d: String!", i))
+		fields = append(fields, fmt.Sprintf("f%d: object(expression: $e%d) { __typename ... on Blob { text isBinary isTruncated } }", i, i))
+		variables[fmt.Sprintf("e%d", i)] = commitRef + ":" + path
+	}
+	query := fmt.Sprintf("query($owner: String!, $name: String!, %s) { repository(owner: $owner, name: $name) { %s } }",
+		strings.Join(params, ", "), strings.Join(fields, " "))
+
+	req, err := s.delegate.NewRequest(http.MethodPost, githubGraphqlURL(s.delegate.BaseURL), map[string]interface{}{
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Data struct {
+			Repository map[string]*githubObject `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	// the query only reads, so it is retried like a GET request
+	resp, err := s.delegate.Do(withIdempotent(ctx), req, &result)
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
+		s.log.Debugf("GraphQL %d: %s (%d files)", resp.StatusCode, resp.Request.URL, len(paths))
+	} else {
+		s.log.Debugf("GraphQL <nil> response encountered, err: %s", err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.Data.Repository == nil {
+		if len(result.Errors) > 0 {
+			return nil, fmt.Errorf("failed to query %s: %s", s.repo.Slug, result.Errors[0].Message)
+		}
+		return nil, fmt.Errorf("failed to query %s: no repository returned", s.repo.Slug)
+	}
+
+	contents := make([]FileContents, len(paths))
+	for i, path := range paths {
+		object := result.Data.Repository[fmt.Sprintf("f%d", i)]
+		switch {
+		case object == nil:
+			contents[i].Err = &statusError{
+				msg:        fmt.Sprintf("failed to get %s: not found", path),
+				statusCode: http.StatusNotFound,
+			}
+		case object.Typename != "Blob":
+			contents[i].Err = fmt.Errorf("failed to get %s: %w", path, ErrNotAFile)
+		case object.Text == nil || object.IsBinary || object.IsTruncated:
+			contents[i].Content, contents[i].Err = s.GetFileContents(ctx, path, commitRef)
+		default:
+			contents[i].Content = *object.Text
+		}
+	}
+	return contents, nil
+}
+
 func (s GithubClient) GetFileListing(ctx context.Context, path string, commitRef string) (
 	fileListing []FileListingEntry, err error) {
 	_, ls, _, err := s.getContents(ctx, path, commitRef)
@@ -126,13 +334,43 @@ func (s GithubClient) GetFileListing(ctx context.Context, path string, commitRef
 	return result, err
 }
 
+func (s GithubClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) (
+	fileListing []FileListingEntry, err error) {
+	tree, _, err := s.getTree(ctx, commitRef)
+	if err != nil {
+		return nil, err
+	}
+	if tree.GetTruncated() {
+		return nil, ErrTreeTruncated
+	}
+
+	var result []FileListingEntry
+	for _, f := range tree.Entries {
+		var fileType string
+		if f.GetType() == "blob" {
+			fileType = "file"
+		} else if f.GetType() == "tree" {
+			fileType = "dir"
+		} else {
+			continue
+		}
+		fileListingEntry := FileListingEntry{
+			Path: f.GetPath(),
+			Name: filepath.Base(f.GetPath()),
+			Type: fileType,
+		}
+		result = append(result, fileListingEntry)
+	}
+	return limitDepth(result, path, maxDepth), nil
+}
+
 func (s GithubClient) listFiles(ctx context.Context, number int, opts *github.ListOptions) (
 	[]*github.CommitFile, *github.Response, error) {
 	f, resp, err := s.delegate.PullRequests.ListFiles(ctx, s.repo.Namespace, s.repo.Name, number, opts)
 	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
-		logrus.Debugf("PullRequest.ListFiles %d: %s", resp.StatusCode, resp.Request.URL)
+		s.log.Debugf("PullRequest.ListFiles %d: %s", resp.StatusCode, resp.Request.URL)
 	} else {
-		logrus.Debugf("PullRequest.ListFiles <nil> response encountered, err: %s", err.Error())
+		s.log.Debugf("PullRequest.ListFiles <nil> response encountered, err: %s", err.Error())
 	}
 	return f, resp, err
 }
@@ -141,21 +379,31 @@ func (s GithubClient) compareCommits(ctx context.Context, base, head string) (
 	*github.CommitsComparison, *github.Response, error) {
 	c, resp, err := s.delegate.Repositories.CompareCommits(ctx, s.repo.Namespace, s.repo.Name, base, head)
 	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
-		logrus.Debugf("PullRequest.CompareCommits %d: %s", resp.StatusCode, resp.Request.URL)
+		s.log.Debugf("PullRequest.CompareCommits %d: %s", resp.StatusCode, resp.Request.URL)
 	} else {
-		logrus.Debugf("PullRequest.CompareCommits <nil> response encountered, err: %s", err.Error())
+		s.log.Debugf("PullRequest.CompareCommits <nil> response encountered, err: %s", err.Error())
 	}
 	return c, resp, err
 }
 
+func (s GithubClient) getTree(ctx context.Context, commitRef string) (*github.Tree, *github.Response, error) {
+	tree, resp, err := s.delegate.Git.GetTree(ctx, s.repo.Namespace, s.repo.Name, commitRef, true)
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
+		s.log.Debugf("Git.GetTree %d: %s", resp.StatusCode, resp.Request.URL)
+	} else {
+		s.log.Debugf("Git.GetTree <nil> response encountered, err: %s", err.Error())
+	}
+	return tree, resp, err
+}
+
 func (s GithubClient) getContents(ctx context.Context, path string, commitRef string) (
 	*github.RepositoryContent, []*github.RepositoryContent, *github.Response, error) {
 	opts := &github.RepositoryContentGetOptions{Ref: commitRef}
 	f, d, resp, err := s.delegate.Repositories.GetContents(ctx, s.repo.Namespace, s.repo.Name, path, opts)
 	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
-		logrus.Debugf("PullRequest.GetContents %d: %s", resp.StatusCode, resp.Request.URL)
+		s.log.Debugf("PullRequest.GetContents %d: %s", resp.StatusCode, resp.Request.URL)
 	} else {
-		logrus.Debugf("PullRequest.GetContents <nil> response encountered, err: %s", err.Error())
+		s.log.Debugf("PullRequest.GetContents <nil> response encountered, err: %s", err.Error())
 	}
 	return f, d, resp, err
 }
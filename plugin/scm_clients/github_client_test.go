@@ -1,6 +1,8 @@
 package scm_clients
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,7 +11,9 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/bitsbeats/drone-tree-config/plugin/scm_clients/scmtest"
 	"github.com/drone/drone-go/drone"
+	"github.com/google/go-github/v33/github"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
@@ -42,6 +46,50 @@ func TestGithubClient_ChangedFilesInDiff(t *testing.T) {
 	BaseTest_ChangedFilesInDiff(t, client)
 }
 
+func TestGithubClient_ChangedFilesInDiff_Truncated(t *testing.T) {
+	client, err := createGithubClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the compare lists 300 files and may be truncated, so the trees are compared instead
+	actualFiles, err := client.ChangedFilesInDiff(noContext, "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 303, len(actualFiles); want != got {
+		t.Fatalf("Want %d files got %d", want, got)
+	}
+	expectedFiles := []string{"a/b/c/d/file", "deleted/file", "moved/file", "moved/file2", "z/file000"}
+	for i, want := range expectedFiles {
+		if got := actualFiles[i]; want != got {
+			t.Errorf("Want %q at %d got %q", want, i, got)
+		}
+	}
+	if want, got := "z/file298", actualFiles[len(actualFiles)-1]; want != got {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestGithubClient_ChangedFilesSinceMergeBase(t *testing.T) {
+	client, err := createGithubClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ChangedFilesSinceMergeBase(t, client)
+}
+
+func TestGithubClient_ListTags(t *testing.T) {
+	client, err := createGithubClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ListTags(t, client)
+}
+
 func TestGithubClient_ChangedFilesInPullRequest(t *testing.T) {
 	client, err := createGithubClient(ts.URL)
 	if err != nil {
@@ -87,6 +135,70 @@ func TestGithubClient_GetFileListing(t *testing.T) {
 	BaseTest_GetFileListing(t, client)
 }
 
+func TestGithubClient_GetFileTree(t *testing.T) {
+	client, err := createGithubClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	BaseTest_GetFileTree(t, client)
+}
+
+func TestGithubClient_GetFileContentsBatch(t *testing.T) {
+	client, err := createGithubClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	contents, err := client.(BatchClient).GetFileContentsBatch(noContext,
+		[]string{"afolder/.drone.yml", "missing/.drone.yml", "afolder"}, "8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 3, len(contents); want != got {
+		t.Fatalf("Want %d results got %d", want, got)
+	}
+
+	want, err := client.GetFileContents(noContext, "afolder/.drone.yml", "8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents[0]; got.Err != nil || got.Content != want {
+		t.Errorf("Want %q got %q (%v)", want, got.Content, got.Err)
+	}
+	if got := Classify(contents[1].Err); got != ErrorNotFound {
+		t.Errorf("Want missing file to be not found, got %v (%v)", got, contents[1].Err)
+	}
+	if !errors.Is(contents[2].Err, ErrNotAFile) {
+		t.Errorf("Want %v got %v", ErrNotAFile, contents[2].Err)
+	}
+}
+
+func TestGithubClient_GraphqlURL(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{"", "https://api.github.com/graphql"},
+		{"https://api.github.com", "https://api.github.com/graphql"},
+		{"https://github.example.com", "https://github.example.com/api/graphql"},
+		{"https://github.example.com/api/v3/", "https://github.example.com/api/graphql"},
+	}
+	for _, test := range tests {
+		client := github.NewClient(nil)
+		if test.server != "" {
+			var err error
+			if client, err = github.NewEnterpriseClient(test.server, test.server, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := githubGraphqlURL(client.BaseURL); test.want != got {
+			t.Errorf("%s: want %s got %s", test.server, test.want, got)
+		}
+	}
+}
+
 func createGithubClient(server string) (ScmClient, error) {
 	someUuid := uuid.New()
 	repo := drone.Repo{
@@ -109,6 +221,15 @@ func testMuxGithub() *http.ServeMux {
 			f, _ := os.Open("../testdata/github/compare.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/compare/master...8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		func(w http.ResponseWriter, r *http.Request) {
+			f, _ := os.Open("../testdata/github/compare.json")
+			_, _ = io.Copy(w, f)
+		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/tags",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `[{"name": "v1.0.0"}, {"name": "v1.1.0"}]`)
+		})
 	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/contents/a/b/.drone.yml",
 		func(w http.ResponseWriter, r *http.Request) {
 			f, _ := os.Open("../testdata/github/a_b_.drone.yml.json")
@@ -145,8 +266,51 @@ func testMuxGithub() *http.ServeMux {
 			f, _ := os.Open("../testdata/github/afolder.json")
 			_, _ = io.Copy(w, f)
 		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/git/trees/8ecad91991d5da985a2a8dd97cc19029dc1c2899",
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("recursive") == "1" {
+				f, _ := os.Open("../testdata/github/tree.json")
+				_, _ = io.Copy(w, f)
+			}
+		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/compare/1111111111111111111111111111111111111111...2222222222222222222222222222222222222222",
+		func(w http.ResponseWriter, r *http.Request) {
+			var files []map[string]string
+			for i := 0; i < 300; i++ {
+				files = append(files, map[string]string{"filename": fmt.Sprintf("z/file%03d", i)})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"merge_base_commit": map[string]string{"sha": "1111111111111111111111111111111111111111"},
+				"files":             files,
+			})
+		})
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/git/trees/1111111111111111111111111111111111111111",
+		githubTree(map[string]string{"unchanged/file": "a", "deleted/file": "b", "moved/file": "c", "a/b/c/d/file": "d"}))
+	mux.HandleFunc("/api/v3/repos/foosinn/dronetest/git/trees/2222222222222222222222222222222222222222",
+		func(w http.ResponseWriter, r *http.Request) {
+			entries := map[string]string{"unchanged/file": "a", "moved/file2": "c", "a/b/c/d/file": "e"}
+			for i := 0; i < 299; i++ {
+				entries[fmt.Sprintf("z/file%03d", i)] = "f"
+			}
+			githubTree(entries)(w, r)
+		})
+	mux.HandleFunc("/api/graphql", scmtest.GithubGraphql("../testdata/github"))
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		logrus.Errorf("Url not found: %s", r.URL)
 	})
 	return mux
 }
+
+// githubTree answers recursive tree requests with the blobs, mapped from path to sha
+func githubTree(blobs map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("recursive") != "1" {
+			return
+		}
+		var entries []map[string]string
+		for path, sha := range blobs {
+			entries = append(entries, map[string]string{"path": path, "type": "blob", "sha": sha})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"tree": entries, "truncated": false})
+	}
+}
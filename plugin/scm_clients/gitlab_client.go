@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/drone/drone-go/drone"
@@ -11,19 +13,16 @@ import (
 	"github.com/xanzy/go-gitlab"
 )
 
+// gitlabCompareMaxFiles is the default maximum number of files listed by the compare api
+const gitlabCompareMaxFiles = 1000
+
 type GitlabClient struct {
 	delegate *gitlab.Client
 	repo     drone.Repo
 }
 
 func NewGitLabClient(ctx context.Context, uuid uuid.UUID, server string, token string, repo drone.Repo) (ScmClient, error) {
-	var client *gitlab.Client
-	var err error
-	if server != "" {
-		client, err = gitlab.NewClient(token, gitlab.WithBaseURL(server))
-	} else {
-		client, err = gitlab.NewClient(token)
-	}
+	client, err := newGitlabDelegate(server, token)
 	if err != nil {
 		return nil, err
 	}
@@ -33,14 +32,96 @@ func NewGitLabClient(ctx context.Context, uuid uuid.UUID, server string, token s
 	}, nil
 }
 
+// VerifyGitLabCredentials checks that the token is accepted by the Gitlab API
+func VerifyGitLabCredentials(ctx context.Context, server string, token string) error {
+	client, err := newGitlabDelegate(server, token)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Users.CurrentUser(gitlab.WithContext(ctx))
+	return err
+}
+
+func newGitlabDelegate(server string, token string) (*gitlab.Client, error) {
+	// retries are handled by the transport, like for the other providers
+	options := []gitlab.ClientOptionFunc{
+		gitlab.WithHTTPClient(newHTTPClient("gitlab")),
+		gitlab.WithoutRetries(),
+	}
+	if server != "" {
+		options = append(options, gitlab.WithBaseURL(server))
+	}
+	return gitlab.NewClient(token, options...)
+}
+
 func (s GitlabClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
-	var changedFiles []string
-	mr, _, err := s.listFiles(pullRequestID)
+	diffs, err := s.listDiffs(ctx, pullRequestID)
+	if StatusCode(err) == http.StatusNotFound {
+		// the diffs endpoint requires Gitlab 15.7, older versions only list the changes of small merge requests
+		return s.listChanges(ctx, pullRequestID)
+	}
 	if err != nil {
 		return nil, err
 	}
-	changes := mr.Changes
-	for _, file := range changes {
+	return changedPaths(diffs), nil
+}
+
+func (s GitlabClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	changes, _, err := s.compareCommits(ctx, base, head, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// the diffs of large comparisons are truncated or missing
+	if changes.CompareTimeout || len(changes.Diffs) >= gitlabCompareMaxFiles {
+		return s.diffTrees(ctx, base, head)
+	}
+	return changedPaths(changes.Diffs), nil
+}
+
+func (s GitlabClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	changes, _, err := s.compareCommits(ctx, base, head, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the diffs of large comparisons are truncated or missing
+	if changes.CompareTimeout || len(changes.Diffs) >= gitlabCompareMaxFiles {
+		mergeBase, _, err := s.delegate.Repositories.MergeBase(s.repo.UID, &gitlab.MergeBaseOptions{
+			Ref: []string{base, head},
+		}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return s.diffTrees(ctx, mergeBase.ID, head)
+	}
+	return changedPaths(changes.Diffs), nil
+}
+
+func (s GitlabClient) ListTags(ctx context.Context) ([]string, error) {
+	var tags []string
+	opts := &gitlab.ListTagsOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+
+	for {
+		page, resp, err := s.delegate.Tags.ListTags(s.repo.UID, opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range page {
+			tags = append(tags, tag.Name)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return tags, nil
+}
+
+// changedPaths returns the paths changed by the diffs, renamed files are listed with their old and new path
+func changedPaths(diffs []*gitlab.Diff) []string {
+	var changedFiles []string
+	for _, file := range diffs {
 		if file.DeletedFile || file.RenamedFile {
 			changedFiles = append(changedFiles, file.OldPath)
 		}
@@ -48,30 +129,41 @@ func (s GitlabClient) ChangedFilesInPullRequest(ctx context.Context, pullRequest
 			changedFiles = append(changedFiles, file.NewPath)
 		}
 	}
-	return changedFiles, nil
+	return changedFiles
 }
 
-func (s GitlabClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
-	var changedFiles []string
-	changes, _, err := s.compareCommits(base, head, true)
+// diffTrees returns the files which differ between the recursive trees of the commits base and head
+func (s GitlabClient) diffTrees(ctx context.Context, base string, head string) ([]string, error) {
+	baseFiles, err := s.treeFiles(ctx, base)
 	if err != nil {
 		return nil, err
 	}
-	for _, file := range changes.Diffs {
-		if file.DeletedFile || file.RenamedFile {
-			changedFiles = append(changedFiles, file.OldPath)
-		}
-		if !file.DeletedFile {
-			changedFiles = append(changedFiles, file.NewPath)
+	headFiles, err := s.treeFiles(ctx, head)
+	if err != nil {
+		return nil, err
+	}
+	return diffFiles(baseFiles, headFiles), nil
+}
+
+// treeFiles returns the object id of every file and submodule in the recursive tree of the commit
+func (s GitlabClient) treeFiles(ctx context.Context, commitRef string) (map[string]string, error) {
+	ls, err := s.listTree(ctx, "", commitRef, true)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string, len(ls))
+	for _, f := range ls {
+		if f.Type == "blob" || f.Type == "commit" {
+			files[f.Path] = f.ID
 		}
 	}
-	return changedFiles, nil
+	return files, nil
 }
 
 func (s GitlabClient) GetFileContents(ctx context.Context, path string, commitRef string) (content string, err error) {
 	data, _, err := s.getContents(ctx, path, commitRef)
-	if data == nil {
-		err = fmt.Errorf("failed to get %s: is not a file", path)
+	if err == nil && data == nil {
+		err = fmt.Errorf("failed to get %s: %w", path, ErrNotAFile)
 	}
 	if err != nil {
 		return "", err
@@ -81,11 +173,25 @@ func (s GitlabClient) GetFileContents(ctx context.Context, path string, commitRe
 
 func (s GitlabClient) GetFileListing(ctx context.Context, path string, commitRef string) (
 	fileListing []FileListingEntry, err error) {
-	ls, _, err := s.getTree(ctx, path, commitRef)
-	var result []FileListingEntry
+	ls, err := s.listTree(ctx, path, commitRef, false)
+	if err != nil {
+		return nil, err
+	}
+	return treeEntries(ls), nil
+}
+
+func (s GitlabClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) (
+	fileListing []FileListingEntry, err error) {
+	ls, err := s.listTree(ctx, path, commitRef, true)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
+	return limitDepth(treeEntries(ls), path, maxDepth), nil
+}
+
+// treeEntries converts the files and directories of a tree listing
+func treeEntries(ls []*gitlab.TreeNode) []FileListingEntry {
+	var result []FileListingEntry
 	for _, f := range ls {
 		var fileType string
 		if f.Type == "blob" {
@@ -102,30 +208,94 @@ func (s GitlabClient) GetFileListing(ctx context.Context, path string, commitRef
 		}
 		result = append(result, fileListingEntry)
 	}
-	return result, err
+	return result
 }
 
-func (s GitlabClient) listFiles(id int) (*gitlab.MergeRequest, *gitlab.Response, error) {
-	return s.delegate.MergeRequests.GetMergeRequestChanges(s.repo.UID, id)
+// listDiffs returns all pages of the merge request diffs
+func (s GitlabClient) listDiffs(ctx context.Context, id int) ([]*gitlab.Diff, error) {
+	// requested without the sdk, which does not support the diffs endpoint yet
+	u := fmt.Sprintf("projects/%s/merge_requests/%d/diffs", url.PathEscape(s.repo.UID), id)
+	opts := &gitlab.ListOptions{PerPage: 100}
+
+	var diffs []*gitlab.Diff
+	for {
+		req, err := s.delegate.NewRequest(http.MethodGet, u, opts, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+		if err != nil {
+			return nil, err
+		}
+		var page []*gitlab.Diff
+		resp, err := s.delegate.Do(req, &page)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return diffs, nil
 }
 
-func (s GitlabClient) compareCommits(base, head string, straight bool) (
+// listChanges returns the changed files of the merge request. The changes of large merge requests are truncated, in
+// this case the trees of the merge request's base and head are compared instead.
+func (s GitlabClient) listChanges(ctx context.Context, id int) ([]string, error) {
+	// requested without the sdk, which does not expose the overflow flag
+	u := fmt.Sprintf("projects/%s/merge_requests/%d/changes", url.PathEscape(s.repo.UID), id)
+	req, err := s.delegate.NewRequest(http.MethodGet, u, nil, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return nil, err
+	}
+	var mr struct {
+		Changes  []*gitlab.Diff `json:"changes"`
+		Overflow bool           `json:"overflow"`
+		DiffRefs struct {
+			BaseSha string `json:"base_sha"`
+			HeadSha string `json:"head_sha"`
+		} `json:"diff_refs"`
+	}
+	if _, err := s.delegate.Do(req, &mr); err != nil {
+		return nil, err
+	}
+	if mr.Overflow {
+		return s.diffTrees(ctx, mr.DiffRefs.BaseSha, mr.DiffRefs.HeadSha)
+	}
+	return changedPaths(mr.Changes), nil
+}
+
+func (s GitlabClient) compareCommits(ctx context.Context, base, head string, straight bool) (
 	*gitlab.Compare, *gitlab.Response, error) {
 	opts := &gitlab.CompareOptions{
 		From:     &base,
 		To:       &head,
 		Straight: &straight,
 	}
-	return s.delegate.Repositories.Compare(s.repo.UID, opts)
+	return s.delegate.Repositories.Compare(s.repo.UID, opts, gitlab.WithContext(ctx))
 }
 
-func (s GitlabClient) getTree(ctx context.Context, path string, commitRef string) (
-	fileContent []*gitlab.TreeNode, resp *gitlab.Response, err error) {
+// listTree returns all pages of the tree listing of path
+func (s GitlabClient) listTree(ctx context.Context, path string, commitRef string, recursive bool) (
+	[]*gitlab.TreeNode, error) {
 	opts := &gitlab.ListTreeOptions{
-		Path: &path,
-		Ref:  &commitRef,
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		Path:        &path,
+		Ref:         &commitRef,
+		Recursive:   &recursive,
+	}
+
+	var ls []*gitlab.TreeNode
+	for {
+		page, resp, err := s.delegate.Repositories.ListTree(s.repo.UID, opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
 	}
-	return s.delegate.Repositories.ListTree(s.repo.UID, opts)
+	return ls, nil
 }
 
 func (s GitlabClient) getContents(ctx context.Context, path string, commitRef string) (
@@ -134,7 +304,7 @@ func (s GitlabClient) getContents(ctx context.Context, path string, commitRef st
 	opts := &gitlab.GetFileOptions{
 		Ref: &commitRef,
 	}
-	return s.delegate.RepositoryFiles.GetFile(s.repo.UID, filteredPath, opts)
+	return s.delegate.RepositoryFiles.GetFile(s.repo.UID, filteredPath, opts, gitlab.WithContext(ctx))
 }
 
 func (s GitlabClient) decode(file *gitlab.File) (string, error) {
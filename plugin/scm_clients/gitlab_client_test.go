@@ -1,10 +1,13 @@
 package scm_clients
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/drone/drone-go/drone"
@@ -36,6 +39,28 @@ func TestGitlabClient_ChangedFilesInDiff(t *testing.T) {
 	BaseTest_ChangedFilesInDiff(t, client)
 }
 
+func TestGitlabClient_ChangedFilesSinceMergeBase(t *testing.T) {
+	ts := httptest.NewServer(testMuxGitlab())
+	defer ts.Close()
+	client, err := createGitlabClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ChangedFilesSinceMergeBase(t, client)
+}
+
+func TestGitlabClient_ListTags(t *testing.T) {
+	ts := httptest.NewServer(testMuxGitlab())
+	defer ts.Close()
+	client, err := createGitlabClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	BaseTest_ListTags(t, client)
+}
+
 func TestGitlabClient_ChangedFilesInPullRequest(t *testing.T) {
 	ts := httptest.NewServer(testMuxGitlab())
 	defer ts.Close()
@@ -60,6 +85,63 @@ func TestGitlabClient_GetFileListing(t *testing.T) {
 	BaseTest_GetFileListing(t, client)
 }
 
+func TestGitlabClient_GetFileTree(t *testing.T) {
+	ts := httptest.NewServer(testMuxGitlab())
+	defer ts.Close()
+	client, err := createGitlabClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	BaseTest_GetFileTree(t, client)
+}
+
+func TestGitlabClient_ChangedFilesInPullRequest_Paginated(t *testing.T) {
+	ts := httptest.NewServer(testMuxGitlab())
+	defer ts.Close()
+	client, err := createGitlabClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	actualFiles, err := client.ChangedFilesInPullRequest(noContext, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"a/.drone.yml", "b/old", "b/new", "c/deleted"}, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
+func TestGitlabClient_ChangedFiles_Overflow(t *testing.T) {
+	ts := httptest.NewServer(testMuxGitlab())
+	defer ts.Close()
+	client, err := createGitlabClient(ts.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the truncated changes of the merge request and the compare are replaced by comparing the trees
+	expectedFiles := []string{"a/b/c/d/file", "deleted/file", "moved/file", "moved/file2"}
+	actualFiles, err := client.ChangedFilesInPullRequest(noContext, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := expectedFiles, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %q got %q", want, got)
+	}
+	actualFiles, err = client.ChangedFilesInDiff(noContext, "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := expectedFiles, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want %q got %q", want, got)
+	}
+}
+
 func createGitlabClient(server string) (ScmClient, error) {
 	someUUID := uuid.New()
 	repo := drone.Repo{
@@ -75,6 +157,15 @@ func testMuxGitlab() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v4/projects/1234/repository/tree",
 		func(w http.ResponseWriter, r *http.Request) {
+			if tree, ok := gitlabTrees[r.FormValue("ref")]; ok && r.FormValue("path") == "" && r.FormValue("recursive") == "true" {
+				gitlabPages(w, r, tree)
+				return
+			}
+			if r.FormValue("path") == "afolder" && r.FormValue("ref") == "8ecad91991d5da985a2a8dd97cc19029dc1c2899" && r.FormValue("recursive") == "true" {
+				f, _ := os.Open("../testdata/gitlab/tree.json")
+				_, _ = io.Copy(w, f)
+				return
+			}
 			if r.FormValue("path") == "afolder" && r.FormValue("ref") == "8ecad91991d5da985a2a8dd97cc19029dc1c2899" {
 				f, _ := os.Open("../testdata/gitlab/afolder.json")
 				_, _ = io.Copy(w, f)
@@ -82,10 +173,52 @@ func testMuxGitlab() *http.ServeMux {
 		})
 	mux.HandleFunc("/api/v4/projects/1234/repository/compare",
 		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("from") == "1111111111111111111111111111111111111111" && r.FormValue("to") == "2222222222222222222222222222222222222222" {
+				_, _ = io.WriteString(w, `{"diffs": [{"new_path": "a/b/c/d/file"}], "compare_timeout": true}`)
+				return
+			}
 			if r.FormValue("from") == "2897b31ec3a1b59279a08a8ad54dc360686327f7" && r.FormValue("to") == "8ecad91991d5da985a2a8dd97cc19029dc1c2899" {
 				f, _ := os.Open("../testdata/gitlab/compare.json")
 				_, _ = io.Copy(w, f)
 			}
+			if r.FormValue("from") == "master" && r.FormValue("to") == "8ecad91991d5da985a2a8dd97cc19029dc1c2899" && r.FormValue("straight") == "false" {
+				f, _ := os.Open("../testdata/gitlab/compare.json")
+				_, _ = io.Copy(w, f)
+			}
+		})
+	mux.HandleFunc("/api/v4/projects/1234/repository/tags",
+		func(w http.ResponseWriter, r *http.Request) {
+			gitlabPages(w, r, []map[string]interface{}{{"name": "v1.0.0"}, {"name": "v1.1.0"}})
+		})
+	mux.HandleFunc("/api/v4/projects/1234/merge_requests/3/diffs",
+		func(w http.ResponseWriter, r *http.Request) {
+			// older Gitlab versions without the diffs endpoint
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message": "404 Not found"}`)
+		})
+	mux.HandleFunc("/api/v4/projects/1234/merge_requests/4/diffs",
+		func(w http.ResponseWriter, r *http.Request) {
+			gitlabPages(w, r, []map[string]interface{}{
+				{"old_path": "a/.drone.yml", "new_path": "a/.drone.yml"},
+				{"old_path": "b/old", "new_path": "b/new", "renamed_file": true},
+				{"old_path": "c/deleted", "new_path": "c/deleted", "deleted_file": true},
+			})
+		})
+	mux.HandleFunc("/api/v4/projects/1234/merge_requests/5/diffs",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"message": "404 Not found"}`)
+		})
+	mux.HandleFunc("/api/v4/projects/1234/merge_requests/5/changes",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `{
+				"changes": [{"old_path": "a/b/c/d/file", "new_path": "a/b/c/d/file"}],
+				"overflow": true,
+				"diff_refs": {
+					"base_sha": "1111111111111111111111111111111111111111",
+					"head_sha": "2222222222222222222222222222222222222222"
+				}
+			}`)
 		})
 	mux.HandleFunc("/api/v4/projects/1234/merge_requests/3/changes",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -112,3 +245,34 @@ func testMuxGitlab() *http.ServeMux {
 	})
 	return mux
 }
+
+// gitlabTrees holds the recursive trees of the commits used to test truncated diffs
+var gitlabTrees = map[string][]map[string]interface{}{
+	"1111111111111111111111111111111111111111": {
+		{"id": "a", "type": "blob", "path": "unchanged/file"},
+		{"id": "b", "type": "blob", "path": "deleted/file"},
+		{"id": "c", "type": "blob", "path": "moved/file"},
+		{"id": "d", "type": "blob", "path": "a/b/c/d/file"},
+	},
+	"2222222222222222222222222222222222222222": {
+		{"id": "a", "type": "blob", "path": "unchanged/file"},
+		{"id": "c", "type": "blob", "path": "moved/file2"},
+		{"id": "e", "type": "blob", "path": "a/b/c/d/file"},
+		{"id": "f", "type": "tree", "path": "a/b/c/d"},
+	},
+}
+
+// gitlabPages serves the items with two items per page
+func gitlabPages(w http.ResponseWriter, r *http.Request, items []map[string]interface{}) {
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end := (page-1)*2, page*2
+	if end < len(items) {
+		w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+	} else {
+		end = len(items)
+	}
+	_ = json.NewEncoder(w).Encode(items[start:end])
+}
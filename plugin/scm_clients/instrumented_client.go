@@ -0,0 +1,100 @@
+package scm_clients
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/bitsbeats/drone-tree-config/plugin/scm_clients")
+
+// instrumentedClient records metrics and a trace span for every call to the delegate ScmClient
+type instrumentedClient struct {
+	delegate ScmClient
+	provider string
+}
+
+// NewInstrumentedClient wraps the client to export metrics and traces labeled with the provider
+func NewInstrumentedClient(provider string, client ScmClient) ScmClient {
+	return instrumentedClient{
+		delegate: client,
+		provider: provider,
+	}
+}
+
+// instrument starts a span for the method. The returned func has to be called with the result of the call.
+func (s instrumentedClient) instrument(ctx context.Context, method string, attrs ...attribute.KeyValue) (
+	context.Context, func(error)) {
+	start := time.Now()
+	attrs = append(attrs, attribute.String("scm.provider", s.provider))
+	ctx, span := tracer.Start(ctx, "scm."+method, trace.WithAttributes(attrs...))
+
+	return ctx, func(err error) {
+		observeRequest(s.provider, method, start, err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (s instrumentedClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) (changedFiles []string, err error) {
+	ctx, done := s.instrument(ctx, "ChangedFilesInPullRequest", attribute.Int("scm.pull_request", pullRequestID))
+	defer func() { done(err) }()
+	return s.delegate.ChangedFilesInPullRequest(ctx, pullRequestID)
+}
+
+func (s instrumentedClient) ChangedFilesInDiff(ctx context.Context, base string, head string) (changedFiles []string, err error) {
+	ctx, done := s.instrument(ctx, "ChangedFilesInDiff", attribute.String("scm.base", base), attribute.String("scm.head", head))
+	defer func() { done(err) }()
+	return s.delegate.ChangedFilesInDiff(ctx, base, head)
+}
+
+func (s instrumentedClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) (changedFiles []string, err error) {
+	ctx, done := s.instrument(ctx, "ChangedFilesSinceMergeBase", attribute.String("scm.base", base), attribute.String("scm.head", head))
+	defer func() { done(err) }()
+	return s.delegate.ChangedFilesSinceMergeBase(ctx, base, head)
+}
+
+func (s instrumentedClient) ListTags(ctx context.Context) (tags []string, err error) {
+	ctx, done := s.instrument(ctx, "ListTags")
+	defer func() { done(err) }()
+	return s.delegate.ListTags(ctx)
+}
+
+func (s instrumentedClient) GetFileContents(ctx context.Context, path string, commitRef string) (content string, err error) {
+	ctx, done := s.instrument(ctx, "GetFileContents", attribute.String("scm.path", path), attribute.String("scm.ref", commitRef))
+	defer func() { done(err) }()
+	return s.delegate.GetFileContents(ctx, path, commitRef)
+}
+
+func (s instrumentedClient) GetFileListing(ctx context.Context, path string, commitRef string) (
+	fileListing []FileListingEntry, err error) {
+	ctx, done := s.instrument(ctx, "GetFileListing", attribute.String("scm.path", path), attribute.String("scm.ref", commitRef))
+	defer func() { done(err) }()
+	return s.delegate.GetFileListing(ctx, path, commitRef)
+}
+
+func (s instrumentedClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) (
+	fileListing []FileListingEntry, err error) {
+	ctx, done := s.instrument(ctx, "GetFileTree", attribute.String("scm.path", path), attribute.String("scm.ref", commitRef),
+		attribute.Int("scm.max_depth", maxDepth))
+	defer func() { done(err) }()
+	return s.delegate.GetFileTree(ctx, path, commitRef, maxDepth)
+}
+
+func (s instrumentedClient) GetFileContentsBatch(ctx context.Context, paths []string, commitRef string) (
+	contents []FileContents, err error) {
+	batchClient, ok := s.delegate.(BatchClient)
+	if !ok {
+		return nil, errBatchUnsupported
+	}
+	ctx, done := s.instrument(ctx, "GetFileContentsBatch", attribute.StringSlice("scm.paths", paths), attribute.String("scm.ref", commitRef))
+	defer func() { done(err) }()
+	return batchClient.GetFileContentsBatch(ctx, paths, commitRef)
+}
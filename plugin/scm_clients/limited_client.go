@@ -0,0 +1,105 @@
+package scm_clients
+
+import (
+	"context"
+)
+
+// limitedClient bounds the number of concurrent calls to the delegate ScmClient
+type limitedClient struct {
+	delegate ScmClient
+	slots    chan struct{}
+}
+
+// NewLimitedClient wraps the client to allow at most limit concurrent calls. Further calls wait for a free slot or
+// until their context is done.
+func NewLimitedClient(limit int, client ScmClient) ScmClient {
+	if limit < 1 {
+		limit = 1
+	}
+	return limitedClient{
+		delegate: client,
+		slots:    make(chan struct{}, limit),
+	}
+}
+
+// acquire waits for a free slot. The slot has to be returned with release.
+func (s limitedClient) acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s limitedClient) release() {
+	<-s.slots
+}
+
+func (s limitedClient) ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.ChangedFilesInPullRequest(ctx, pullRequestID)
+}
+
+func (s limitedClient) ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.ChangedFilesInDiff(ctx, base, head)
+}
+
+func (s limitedClient) ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.ChangedFilesSinceMergeBase(ctx, base, head)
+}
+
+func (s limitedClient) ListTags(ctx context.Context) ([]string, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.ListTags(ctx)
+}
+
+func (s limitedClient) GetFileContents(ctx context.Context, path string, commitRef string) (string, error) {
+	if err := s.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer s.release()
+	return s.delegate.GetFileContents(ctx, path, commitRef)
+}
+
+func (s limitedClient) GetFileListing(ctx context.Context, path string, commitRef string) ([]FileListingEntry, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.GetFileListing(ctx, path, commitRef)
+}
+
+func (s limitedClient) GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) ([]FileListingEntry, error) {
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return s.delegate.GetFileTree(ctx, path, commitRef, maxDepth)
+}
+
+func (s limitedClient) GetFileContentsBatch(ctx context.Context, paths []string, commitRef string) ([]FileContents, error) {
+	batchClient, ok := s.delegate.(BatchClient)
+	if !ok {
+		return nil, errBatchUnsupported
+	}
+	if err := s.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	return batchClient.GetFileContentsBatch(ctx, paths, commitRef)
+}
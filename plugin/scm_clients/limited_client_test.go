@@ -0,0 +1,101 @@
+package scm_clients
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowClient tracks the maximum number of concurrent calls, the calls block until release is closed
+type slowClient struct {
+	countingClient
+	running int32
+	max     int32
+	release chan struct{}
+}
+
+func (c *slowClient) GetFileContents(ctx context.Context, path string, commitRef string) (string, error) {
+	running := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	for {
+		max := atomic.LoadInt32(&c.max)
+		if running <= max || atomic.CompareAndSwapInt32(&c.max, max, running) {
+			break
+		}
+	}
+	<-c.release
+	return path, nil
+}
+
+func TestLimitedClient(t *testing.T) {
+	delegate := &slowClient{release: make(chan struct{})}
+	client := NewLimitedClient(3, delegate)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetFileContents(noContext, ".drone.yml", "master"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// wait for the calls to take all slots, the others have to wait for them
+	for atomic.LoadInt32(&delegate.running) < 3 {
+		runtime.Gosched()
+	}
+	close(delegate.release)
+	wg.Wait()
+	if limit, got := int32(3), atomic.LoadInt32(&delegate.max); got > limit {
+		t.Errorf("Want at most %d concurrent calls got %d", limit, got)
+	}
+
+	// waiting calls are cancelled with their context
+	ctx, cancel := context.WithTimeout(noContext, 5*time.Millisecond)
+	defer cancel()
+	blocked := NewLimitedClient(1, delegate).(limitedClient)
+	blocked.slots <- struct{}{}
+	if _, err := blocked.GetFileContents(ctx, ".drone.yml", "master"); err != context.DeadlineExceeded {
+		t.Errorf("Want %v got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	var running, max int32
+	release := make(chan struct{})
+	called := make([]bool, 20)
+	done := make(chan struct{})
+	go func() {
+		ForEach(3, len(called), func(i int) {
+			current := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if current <= m || atomic.CompareAndSwapInt32(&max, m, current) {
+					break
+				}
+			}
+			<-release
+			called[i] = true
+		})
+		close(done)
+	}()
+
+	for atomic.LoadInt32(&running) < 3 {
+		runtime.Gosched()
+	}
+	close(release)
+	<-done
+	if limit, got := int32(3), atomic.LoadInt32(&max); got > limit {
+		t.Errorf("Want at most %d workers got %d", limit, got)
+	}
+	for i, ok := range called {
+		if !ok {
+			t.Errorf("Want call for index %d", i)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package scm_clients
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scmRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_requests_total",
+			Help:      "Number of SCM API calls by provider, method and status code.",
+		},
+		[]string{"provider", "method", "code"},
+	)
+	scmRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_request_duration_seconds",
+			Help:      "Latency of SCM API calls by provider and method.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"provider", "method"},
+	)
+	scmRetriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_retries_total",
+			Help:      "Number of retried SCM HTTP requests by provider and status code of the failed attempt.",
+		},
+		[]string{"provider", "code"},
+	)
+	scmRateLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_rate_limit",
+			Help:      "Request quota reported by the SCM by provider and rate limit resource.",
+		},
+		[]string{"provider", "resource"},
+	)
+	scmRateLimitRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_rate_limit_remaining",
+			Help:      "Remaining request quota reported by the SCM by provider and rate limit resource.",
+		},
+		[]string{"provider", "resource"},
+	)
+	scmRateLimitReset = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_rate_limit_reset_timestamp_seconds",
+			Help:      "Unix time at which the SCM resets the request quota by provider and rate limit resource.",
+		},
+		[]string{"provider", "resource"},
+	)
+	scmCacheOperationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_cache_operations_total",
+			Help:      "Number of SCM file cache operations by method and result (hit, miss, evict).",
+		},
+		[]string{"method", "result"},
+	)
+	scmCacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "drone_tree_config",
+			Name:      "scm_cache_bytes",
+			Help:      "Estimated size of the entries in the SCM file cache.",
+		},
+	)
+)
+
+// observeRequest records a single SCM call which was started at start
+func observeRequest(provider string, method string, start time.Time, err error) {
+	code := "ok"
+	if err != nil {
+		code = "error"
+		if statusCode := StatusCode(err); statusCode != 0 {
+			code = strconv.Itoa(statusCode)
+		}
+	}
+	scmRequestsTotal.WithLabelValues(provider, method, code).Inc()
+	scmRequestDuration.WithLabelValues(provider, method).Observe(time.Since(start).Seconds())
+}
@@ -2,6 +2,10 @@ package scm_clients
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type FileListingEntry struct {
@@ -13,8 +17,124 @@ type FileListingEntry struct {
 type ScmClient interface {
 	ChangedFilesInPullRequest(ctx context.Context, pullRequestID int) ([]string, error)
 	ChangedFilesInDiff(ctx context.Context, base string, head string) ([]string, error)
+	// ChangedFilesSinceMergeBase lists the files changed on head since it diverged from base, i.e. the diff between
+	// the merge base of both commits and head
+	ChangedFilesSinceMergeBase(ctx context.Context, base string, head string) ([]string, error)
+	// ListTags returns the names of all tags of the repository
+	ListTags(ctx context.Context) ([]string, error)
 	GetFileContents(ctx context.Context, path string, commitRef string) (
 		fileContent string, err error)
 	GetFileListing(ctx context.Context, path string, commitRef string) (
 		fileListing []FileListingEntry, err error)
+	// GetFileTree lists all files and directories below path which are nested in at most maxDepth directories. It
+	// returns ErrTreeTruncated if the provider is unable to list the complete tree.
+	GetFileTree(ctx context.Context, path string, commitRef string, maxDepth int) (
+		fileListing []FileListingEntry, err error)
+}
+
+// FileContents holds the content of a single file of a batch, or the error if the file could not be fetched
+type FileContents struct {
+	Content string
+	Err     error
+}
+
+// BatchClient is implemented by ScmClients which are able to fetch multiple files with a single request
+type BatchClient interface {
+	// GetFileContentsBatch returns the contents of the files at commitRef in the order of paths. The failure of a
+	// single file is reported in its FileContents, an error is only returned if the whole batch failed.
+	GetFileContentsBatch(ctx context.Context, paths []string, commitRef string) (contents []FileContents, err error)
+}
+
+// errBatchUnsupported is returned by wrapping clients if their delegate does not implement BatchClient
+var errBatchUnsupported = errors.New("batch requests are not supported")
+
+// GetFileContentsBatch fetches the files with a single batch if the client implements BatchClient. If it does not, or
+// the batch failed, each file is fetched with GetFileContents by a pool of workers instead.
+func GetFileContentsBatch(ctx context.Context, client ScmClient, paths []string, commitRef string, workers int) []FileContents {
+	if len(paths) == 0 {
+		return nil
+	}
+	if batchClient, ok := client.(BatchClient); ok {
+		contents, err := batchClient.GetFileContentsBatch(ctx, paths, commitRef)
+		if err == nil {
+			return contents
+		}
+	}
+	return getFileContentsEach(ctx, client, paths, commitRef, workers)
+}
+
+// getFileContentsEach fetches the files with GetFileContents, using at most workers concurrent calls
+func getFileContentsEach(ctx context.Context, client ScmClient, paths []string, commitRef string, workers int) []FileContents {
+	contents := make([]FileContents, len(paths))
+	ForEach(workers, len(paths), func(i int) {
+		contents[i].Content, contents[i].Err = client.GetFileContents(ctx, paths[i], commitRef)
+	})
+	return contents
+}
+
+// ForEach calls fn for each index in [0, n) with a pool of at most workers goroutines and waits for all calls to
+// return. Results are expected to be written to the slot of the index.
+func ForEach(workers int, n int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// limitDepth returns the entries below root which are nested in at most maxDepth directories, relative to root
+func limitDepth(entries []FileListingEntry, root string, maxDepth int) []FileListingEntry {
+	prefix := strings.Trim(root, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var result []FileListingEntry
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(entry.Path, prefix)
+		if rel == "" || strings.Count(rel, "/") > maxDepth {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// diffFiles compares two listings which map the file paths to their object ids. It returns the sorted paths which
+// differ, including the paths which only exist in one of the listings.
+func diffFiles(baseFiles map[string]string, headFiles map[string]string) []string {
+	var changedFiles []string
+	for path, id := range headFiles {
+		if baseID, exists := baseFiles[path]; !exists || baseID != id {
+			changedFiles = append(changedFiles, path)
+		}
+	}
+	for path := range baseFiles {
+		if _, exists := headFiles[path]; !exists {
+			changedFiles = append(changedFiles, path)
+		}
+	}
+	sort.Strings(changedFiles)
+	return changedFiles
 }
@@ -38,6 +38,34 @@ func BaseTest_ChangedFilesInDiff(t *testing.T, client ScmClient) {
 	}
 }
 
+func BaseTest_ChangedFilesSinceMergeBase(t *testing.T, client ScmClient) {
+	actualFiles, err := client.ChangedFilesSinceMergeBase(noContext, "master", "8ecad91991d5da985a2a8dd97cc19029dc1c2899")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedFiles := []string{
+		"a/b/c/d/file",
+	}
+
+	if want, got := expectedFiles, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Test failed:\n  want %q\n   got %q", want, got)
+	}
+}
+
+func BaseTest_ListTags(t *testing.T, client ScmClient) {
+	actualTags, err := client.ListTags(noContext)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if want, got := []string{"v1.0.0", "v1.1.0"}, actualTags; !reflect.DeepEqual(want, got) {
+		t.Errorf("Test failed:\n  want %q\n   got %q", want, got)
+	}
+}
+
 func BaseTest_ChangedFilesInPullRequest(t *testing.T, client ScmClient) {
 	actualFiles, err := client.ChangedFilesInPullRequest(noContext, 3)
 	if err != nil {
@@ -70,3 +98,21 @@ func BaseTest_GetFileListing(t *testing.T, client ScmClient) {
 		t.Errorf("Test failed:\n  want %q\n   got %q", want, got)
 	}
 }
+
+func BaseTest_GetFileTree(t *testing.T, client ScmClient) {
+	actualFiles, err := client.GetFileTree(noContext, "afolder", "8ecad91991d5da985a2a8dd97cc19029dc1c2899", 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedFiles := []FileListingEntry{
+		{Type: "file", Path: "afolder/.drone.yml", Name: ".drone.yml"},
+		{Type: "dir", Path: "afolder/abfolder", Name: "abfolder"},
+		{Type: "dir", Path: "afolder/abfolder/acfolder", Name: "acfolder"},
+	}
+
+	if want, got := expectedFiles, actualFiles; !reflect.DeepEqual(want, got) {
+		t.Errorf("Test failed:\n  want %q\n   got %q", want, got)
+	}
+}
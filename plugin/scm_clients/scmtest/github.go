@@ -0,0 +1,53 @@
+// Package scmtest provides fake SCM API endpoints for the tests of the plugin and the SCM clients.
+package scmtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// GithubGraphql answers the batched file queries with the contents api responses stored in dir
+func GithubGraphql(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var query struct {
+			Variables map[string]string `json:"variables"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&query)
+
+		repository := map[string]interface{}{}
+		for name, expression := range query.Variables {
+			if !strings.HasPrefix(name, "e") {
+				continue
+			}
+			alias := "f" + strings.TrimPrefix(name, "e")
+			path := expression[strings.Index(expression, ":")+1:]
+			repository[alias] = nil
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, strings.ReplaceAll(path, "/", "_")+".json"))
+			if err != nil {
+				continue
+			}
+			var file struct {
+				Content string `json:"content"`
+			}
+			if err := json.Unmarshal(data, &file); err != nil {
+				repository[alias] = map[string]interface{}{"__typename": "Tree"}
+				continue
+			}
+			text, _ := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
+			repository[alias] = map[string]interface{}{
+				"__typename":  "Blob",
+				"text":        string(text),
+				"isBinary":    false,
+				"isTruncated": false,
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"repository": repository},
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package scm_clients
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// retryMax is the number of times a failed idempotent request is retried
+	retryMax = 3
+	// retryMinWait is the backoff before the first retry, it is doubled for every further retry
+	retryMinWait = 250 * time.Millisecond
+	// retryMaxWait is the longest time to wait before a retry. Requests which are throttled for longer are not retried.
+	retryMaxWait = 10 * time.Second
+)
+
+// idempotentKey marks requests which may be retried even though their method is not idempotent
+type idempotentKey struct{}
+
+// withIdempotent marks the requests sent with ctx as idempotent, e.g. read only GraphQL queries
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// retryTransport retries idempotent requests which were throttled or failed with a server or network error. The
+// wait time is taken from the Retry-After and rate limit reset headers, otherwise an exponential backoff is used.
+// The rate limit headers of all responses are exported as metrics.
+type retryTransport struct {
+	provider string
+	base     http.RoundTripper
+	retryMax int
+	minWait  time.Duration
+	maxWait  time.Duration
+}
+
+// newHTTPClient creates a http.Client for the provider which retries failed idempotent requests
+func newHTTPClient(provider string) *http.Client {
+	return &http.Client{Transport: newRetryTransport(provider, http.DefaultTransport)}
+}
+
+// newRetryTransport wraps base to retry failed idempotent requests
+func newRetryTransport(provider string, base http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		provider: provider,
+		base:     base,
+		retryMax: retryMax,
+		minWait:  retryMinWait,
+		maxWait:  retryMaxWait,
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := isIdempotent(req)
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if resp != nil {
+			observeRateLimit(t.provider, resp.Header)
+		}
+		if !retryable || attempt >= t.retryMax || !shouldRetry(req.Context(), resp, err) {
+			return resp, err
+		}
+
+		wait := t.backoff(attempt, resp)
+		if wait > t.maxWait {
+			return resp, err
+		}
+		code := "error"
+		if resp != nil {
+			code = strconv.Itoa(resp.StatusCode)
+			drainBody(resp)
+		}
+		scmRetriesTotal.WithLabelValues(t.provider, code).Inc()
+
+		// the body was consumed by the previous attempt
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the time to wait before the retry of the attempt
+func (t *retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, ok := retryAfter(resp.Header); ok {
+			return wait
+		}
+	}
+	wait := t.minWait << uint(attempt)
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// isIdempotent returns true if the request may be sent more than once
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent && (req.Body == nil || req.GetBody != nil)
+}
+
+// shouldRetry returns true if the request was throttled or failed with a server or network error
+func shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true
+	case resp.StatusCode == http.StatusForbidden:
+		// Github reports exceeded rate limits as forbidden
+		_, throttled := retryAfter(resp.Header)
+		return throttled
+	}
+	return false
+}
+
+// retryAfter returns the wait time announced by the Retry-After header or, once the rate limit is exhausted, by the
+// rate limit reset header
+func retryAfter(header http.Header) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return positive(time.Until(date)), true
+		}
+	}
+	if rateLimitHeader(header, "Remaining") == "0" {
+		if reset, err := strconv.ParseInt(rateLimitHeader(header, "Reset"), 10, 64); err == nil {
+			return positive(time.Until(time.Unix(reset, 0))), true
+		}
+	}
+	return 0, false
+}
+
+// rateLimitHeader returns the rate limit header used by Github and Bitbucket (X-RateLimit-name) or Gitlab
+// (RateLimit-name)
+func rateLimitHeader(header http.Header, name string) string {
+	if value := header.Get("X-RateLimit-" + name); value != "" {
+		return value
+	}
+	return header.Get("RateLimit-" + name)
+}
+
+// observeRateLimit exports the rate limit headers of a response
+func observeRateLimit(provider string, header http.Header) {
+	resource := rateLimitHeader(header, "Resource")
+	if limit, err := strconv.ParseFloat(rateLimitHeader(header, "Limit"), 64); err == nil {
+		scmRateLimit.WithLabelValues(provider, resource).Set(limit)
+	}
+	if remaining, err := strconv.ParseFloat(rateLimitHeader(header, "Remaining"), 64); err == nil {
+		scmRateLimitRemaining.WithLabelValues(provider, resource).Set(remaining)
+	}
+	if reset, err := strconv.ParseFloat(rateLimitHeader(header, "Reset"), 64); err == nil {
+		scmRateLimitReset.WithLabelValues(provider, resource).Set(reset)
+	}
+}
+
+// drainBody reads and closes the body, so the connection can be reused
+func drainBody(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	_ = resp.Body.Close()
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,107 @@
+package scm_clients
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyServer fails the first failures requests with the status and headers
+func flakyServer(failures int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) <= failures {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-RateLimit-Resource", "core")
+		_, _ = w.Write(body)
+	}))
+	return server, &calls
+}
+
+func testTransport() *retryTransport {
+	transport := newRetryTransport("test", http.DefaultTransport)
+	transport.minWait = time.Millisecond
+	transport.maxWait = time.Second
+	return transport
+}
+
+func TestRetryTransport(t *testing.T) {
+	for name, tc := range map[string]struct {
+		failures int32
+		status   int
+		header   http.Header
+		method   string
+		calls    int32
+		code     int
+	}{
+		"ServerError":      {failures: 2, status: 502, method: "GET", calls: 3, code: 200},
+		"TooManyRequests":  {failures: 1, status: 429, header: http.Header{"Retry-After": {"0"}}, method: "GET", calls: 2, code: 200},
+		"RateLimitReset":   {failures: 1, status: 403, header: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {strconv.FormatInt(time.Now().Unix(), 10)}}, method: "GET", calls: 2, code: 200},
+		"GitlabReset":      {failures: 1, status: 429, header: http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {strconv.FormatInt(time.Now().Unix(), 10)}}, method: "GET", calls: 2, code: 200},
+		"RetriesExhausted": {failures: 10, status: 503, method: "GET", calls: 4, code: 503},
+		"ResetTooLate":     {failures: 1, status: 429, header: http.Header{"Retry-After": {"3600"}}, method: "GET", calls: 1, code: 429},
+		"Forbidden":        {failures: 1, status: 403, method: "GET", calls: 1, code: 403},
+		"NotIdempotent":    {failures: 1, status: 502, method: "POST", calls: 1, code: 502},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, calls := flakyServer(tc.failures, tc.status, tc.header)
+			defer server.Close()
+
+			req, _ := http.NewRequest(tc.method, server.URL, nil)
+			resp, err := testTransport().RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if want, got := tc.code, resp.StatusCode; want != got {
+				t.Errorf("Want status %d got %d", want, got)
+			}
+			if want, got := tc.calls, atomic.LoadInt32(calls); want != got {
+				t.Errorf("Want %d calls got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestRetryTransport_Idempotent(t *testing.T) {
+	server, calls := flakyServer(1, 502, nil)
+	defer server.Close()
+
+	// the body is sent again with the retry
+	req, _ := http.NewRequestWithContext(withIdempotent(noContext), "POST", server.URL, strings.NewReader("query"))
+	resp, err := testTransport().RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if want, got := "query", string(body); want != got {
+		t.Errorf("Want body %q got %q", want, got)
+	}
+	if want, got := int32(2), atomic.LoadInt32(calls); want != got {
+		t.Errorf("Want %d calls got %d", want, got)
+	}
+
+	// the rate limit headers are exported
+	if want, got := 4999.0, testutil.ToFloat64(scmRateLimitRemaining.WithLabelValues("test", "core")); want != got {
+		t.Errorf("Want remaining quota %v got %v", want, got)
+	}
+	if want, got := 5000.0, testutil.ToFloat64(scmRateLimit.WithLabelValues("test", "core")); want != got {
+		t.Errorf("Want quota %v got %v", want, got)
+	}
+}
@@ -0,0 +1,334 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Strategy selects the drone configs of a build
+type Strategy string
+
+const (
+	// StrategyChanges selects the configs of the changed files, this is the default for all events
+	StrategyChanges Strategy = "changes"
+	// StrategyAll selects all configs of the repository
+	StrategyAll Strategy = "all"
+	// StrategyPreviousTag selects the configs of the files changed since the previous tag, e.g. v1.2.2 for v1.2.3
+	StrategyPreviousTag Strategy = "previous-tag"
+	// StrategyTagPrefix selects the config of the directory named by the tag, e.g. services/api for services/api/v1.4.0
+	StrategyTagPrefix Strategy = "tag-prefix"
+	// StrategyParams selects the configs of the directories listed in the TREE_PATHS build parameter, this is the
+	// default for custom events
+	StrategyParams Strategy = "params"
+)
+
+// PathsParam is the build parameter holding the comma separated directories selected by StrategyParams. The value
+// `*` selects all configs.
+const PathsParam = "TREE_PATHS"
+
+// DefaultTagPattern matches the directory of a tag up to its last slash, e.g. services/api of services/api/v1.4.0
+const DefaultTagPattern = `^(.+)/[^/]+$`
+
+// strategies holds all known strategies
+var strategies = map[Strategy]bool{
+	StrategyChanges:     true,
+	StrategyAll:         true,
+	StrategyPreviousTag: true,
+	StrategyTagPrefix:   true,
+	StrategyParams:      true,
+}
+
+// defaultStrategies holds the strategies of the events which do not use StrategyChanges by default
+var defaultStrategies = map[string]Strategy{
+	"custom": StrategyParams,
+}
+
+// selection holds the configs selected for a build: the configs of the changed files, the configs of the directories
+// or all configs
+type selection struct {
+	changedFiles []string
+	dirs         []string
+	all          bool
+}
+
+// defaultTagPattern is used if no tag pattern is configured
+var defaultTagPattern = regexp.MustCompile(DefaultTagPattern)
+
+// versionTag matches the version part of a tag name, e.g. v1.2.3 of svc-a/v1.2.3
+var versionTag = regexp.MustCompile(`^v?[0-9]`)
+
+// ParseEventStrategies parses a map of build events, e.g. tag or promote, to strategy names
+func ParseEventStrategies(eventStrategies map[string]string) (map[string]Strategy, error) {
+	parsed := make(map[string]Strategy, len(eventStrategies))
+	for event, name := range eventStrategies {
+		strategy := Strategy(name)
+		if !strategies[strategy] {
+			return nil, fmt.Errorf("unknown strategy %q for event %q", name, event)
+		}
+		parsed[event] = strategy
+	}
+	return parsed, nil
+}
+
+// ParseTagPattern compiles the pattern used by StrategyTagPrefix, its first group has to match the directory
+func ParseTagPattern(pattern string) (*regexp.Regexp, error) {
+	tagPattern, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if tagPattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("missing group for the directory in %q", pattern)
+	}
+	return tagPattern, nil
+}
+
+// strategy returns the strategy configured for the build event
+func (p *Plugin) strategy(event string) Strategy {
+	if strategy, ok := p.eventStrategies[event]; ok {
+		return strategy
+	}
+	if strategy, ok := defaultStrategies[event]; ok {
+		return strategy
+	}
+	return StrategyChanges
+}
+
+// selectConfigs selects the configs of the build according to the strategy of its event
+func (p *Plugin) selectConfigs(ctx context.Context, req *request) (*selection, error) {
+	switch strategy := p.strategy(req.Build.Event); strategy {
+	case StrategyAll:
+		req.Log.Infof("%s event, rebuilding all", req.Build.Event)
+		return &selection{all: true}, nil
+	case StrategyPreviousTag:
+		tag := strings.TrimPrefix(req.Build.Ref, "refs/tags/")
+		if tag == req.Build.Ref {
+			break
+		}
+		previous, err := p.previousTag(ctx, req, tag)
+		if err != nil {
+			req.Log.Errorf("unable to list tags: '%v'", err)
+			return nil, err
+		}
+		if previous == "" {
+			req.Log.Infof("no tag before %s, rebuilding all", tag)
+			return &selection{all: true}, nil
+		}
+		req.Log.Debugf("comparing tag %s with %s", tag, previous)
+		changedFiles, err := req.Client.ChangedFilesInDiff(ctx, previous, req.Build.After)
+		if err != nil {
+			req.Log.Errorf("unable to fetch diff: '%v'", err)
+			return nil, err
+		}
+		if len(changedFiles) == 0 {
+			return &selection{}, nil
+		}
+		return &selection{changedFiles: changedFiles}, nil
+	case StrategyTagPrefix:
+		tag := strings.TrimPrefix(req.Build.Ref, "refs/tags/")
+		if tag == req.Build.Ref {
+			break
+		}
+		dir, ok := p.tagDir(tag)
+		if !ok {
+			req.Log.Infof("tag %s does not name a directory, using the changed files", tag)
+			break
+		}
+		req.Log.Infof("tag %s selects %s", tag, dir)
+		return &selection{dirs: []string{dir}}, nil
+	case StrategyParams:
+		value, ok := req.Build.Params[PathsParam]
+		if !ok {
+			break
+		}
+		if strings.TrimSpace(value) == "*" {
+			req.Log.Infof("%s=%s, rebuilding all", PathsParam, value)
+			return &selection{all: true}, nil
+		}
+		dirs := paramDirs(req, value)
+		if len(dirs) == 0 {
+			return nil, fmt.Errorf("no directory in build parameter %s=%q", PathsParam, value)
+		}
+		req.Log.Infof("%s selects %s", PathsParam, strings.Join(dirs, ", "))
+		return &selection{dirs: dirs}, nil
+	}
+
+	changedFiles, err := p.getScmChanges(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &selection{changedFiles: changedFiles}, nil
+}
+
+// tagDir returns the directory named by the tag, as matched by the first group of the tag pattern
+func (p *Plugin) tagDir(tag string) (string, bool) {
+	tagPattern := p.tagPattern
+	if tagPattern == nil {
+		tagPattern = defaultTagPattern
+	}
+	match := tagPattern.FindStringSubmatch(tag)
+	if len(match) < 2 {
+		return "", false
+	}
+	dir := path.Clean(strings.Trim(match[1], "/"))
+	if dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", false
+	}
+	return dir, true
+}
+
+// paramDirs parses the comma separated directories of the paths parameter. The root directory is selected by `.` or
+// `/`, paths of config files are accepted as well, e.g. services/api/.drone.yml.
+func paramDirs(req *request, value string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		dir := path.Clean(strings.Trim(entry, "/"))
+		if path.Base(dir) == req.Repo.Config {
+			dir = path.Dir(dir)
+		}
+		if dir == ".." || strings.HasPrefix(dir, "../") {
+			req.Log.Warnf("skipping %s, outside of the repository", entry)
+			continue
+		}
+		if dir == "." {
+			dir = ""
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// previousTag returns the tag with the highest version below the version of tag. Only tags with the same prefix are
+// considered, e.g. svc-a/v1.2.2 for svc-a/v1.2.3. It returns an empty string if there is no previous tag.
+func (p *Plugin) previousTag(ctx context.Context, req *request, tag string) (string, error) {
+	prefix, version := splitTag(tag)
+	if !versionTag.MatchString(version) {
+		return "", nil
+	}
+
+	tags, err := req.Client.ListTags(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	previous, previousVersion := "", ""
+	for _, candidate := range tags {
+		candidatePrefix, candidateVersion := splitTag(candidate)
+		if candidatePrefix != prefix || !versionTag.MatchString(candidateVersion) {
+			continue
+		}
+		if compareVersions(candidateVersion, version) < 0 &&
+			(previous == "" || compareVersions(candidateVersion, previousVersion) > 0) {
+			previous, previousVersion = candidate, candidateVersion
+		}
+	}
+	return previous, nil
+}
+
+// splitTag splits the tag into the prefix up to the last slash and the version
+func splitTag(tag string) (prefix string, version string) {
+	i := strings.LastIndex(tag, "/")
+	return tag[:i+1], tag[i+1:]
+}
+
+// compareVersions compares two versions by their dot separated parts, numeric parts are compared as numbers, e.g.
+// v1.10.0 > v1.9.2. A version with a pre-release suffix is lower than the release, e.g. 1.2.0-rc1 < 1.2.0, the
+// pre-releases are compared by their parts as well, e.g. 1.2.0-rc9 < 1.2.0-rc10.
+func compareVersions(a string, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	aCore, aPre := splitPreRelease(a)
+	bCore, bPre := splitPreRelease(b)
+
+	aParts, bParts := strings.Split(aCore, "."), strings.Split(bCore, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		aPart, bPart := "0", "0"
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if c := comparePart(aPart, bPart); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+
+	aParts, bParts = splitPreReleaseParts(aPre), splitPreReleaseParts(bPre)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if c := comparePart(aParts[i], bParts[i]); c != 0 {
+			return c
+		}
+	}
+	// a pre-release with more parts is higher, e.g. rc.1 > rc
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
+
+// splitPreRelease splits the version at the first dash
+func splitPreRelease(version string) (core string, preRelease string) {
+	if i := strings.Index(version, "-"); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+	return version, ""
+}
+
+// splitPreReleaseParts splits the pre-release at dots and between letters and digits, e.g. rc10 into rc and 10
+func splitPreReleaseParts(preRelease string) []string {
+	var parts []string
+	for _, field := range strings.Split(preRelease, ".") {
+		start := 0
+		for i := 1; i < len(field); i++ {
+			if isDigit(field[i]) != isDigit(field[i-1]) {
+				parts = append(parts, field[start:i])
+				start = i
+			}
+		}
+		parts = append(parts, field[start:])
+	}
+	return parts
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// comparePart compares two parts of a version, numbers are compared by their value
+func comparePart(a string, b string) int {
+	aNum, aErr := strconv.Atoi(a)
+	bNum, bErr := strconv.Atoi(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case aNum < bNum:
+		return -1
+	case aNum > bNum:
+		return 1
+	}
+	return 0
+}
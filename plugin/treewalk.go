@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+)
+
+// treeNode is a directory or a drone config of a scanned tree
+type treeNode struct {
+	path     string
+	dir      bool
+	depth    int
+	ldc      *LoadedDroneConfig
+	children []*treeNode
+	err      error
+}
+
+// merge appends the configs of the node and its children depth first. It returns the first critical error.
+func (n *treeNode) merge(dcc *DroneConfigCombiner) error {
+	if n.err != nil {
+		return n.err
+	}
+	if n.ldc != nil {
+		dcc.Append(n.ldc)
+	}
+	for _, child := range n.children {
+		if err := child.merge(dcc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeWalk scans a tree with a fixed number of workers. The entries of each listed directory are added to a shared
+// worklist, so the number of goroutines does not grow with the size or the depth of the tree.
+type treeWalk struct {
+	p   *Plugin
+	req *request
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the nodes which are not scanned yet, pending additionally counts the nodes which are being scanned
+	queue   []*treeNode
+	pending int
+}
+
+// walkTree scans the tree below root and returns the scanned root node
+func (p *Plugin) walkTree(ctx context.Context, req *request, root *treeNode) *treeNode {
+	w := &treeWalk{p: p, req: req}
+	w.cond = sync.NewCond(&w.mu)
+	w.push(root)
+
+	workers := p.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				node, ok := w.pop()
+				if !ok {
+					return
+				}
+				w.scan(ctx, node)
+				w.done()
+			}
+		}()
+	}
+	wg.Wait()
+	return root
+}
+
+// push adds the nodes to the worklist
+func (w *treeWalk) push(nodes ...*treeNode) {
+	w.mu.Lock()
+	w.queue = append(w.queue, nodes...)
+	w.pending += len(nodes)
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// pop waits for the next node. It returns false once all nodes are scanned.
+func (w *treeWalk) pop() (*treeNode, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.queue) == 0 && w.pending > 0 {
+		w.cond.Wait()
+	}
+	if len(w.queue) == 0 {
+		return nil, false
+	}
+	node := w.queue[0]
+	w.queue = w.queue[1:]
+	return node, true
+}
+
+// done marks a popped node as scanned
+func (w *treeWalk) done() {
+	w.mu.Lock()
+	w.pending--
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// scan loads the drone config of a file node, or lists a directory node and adds its entries to the worklist
+func (w *treeWalk) scan(ctx context.Context, node *treeNode) {
+	p, req := w.p, w.req
+	if !node.dir {
+		ldc, critical, err := p.getDroneConfig(ctx, req, node.path)
+		if critical {
+			node.err = err
+		} else if err == nil {
+			node.ldc = ldc
+		}
+		return
+	}
+
+	ls, err := req.Client.GetFileListing(ctx, node.path, req.Build.After)
+	if err != nil {
+		node.err = err
+		return
+	}
+
+	if node.depth > p.maxDepth {
+		req.Log.Infof("skipping scan of %s, max depth %d reached.", node.path, node.depth)
+		return
+	}
+
+	if !p.concat && len(ls) > 0 {
+		req.Log.Info("concat is disabled. Using just first .drone.yml.")
+		ls = ls[:1]
+	}
+
+	for _, f := range ls {
+		if f.Type == "dir" {
+			node.children = append(node.children, &treeNode{path: f.Path, dir: true, depth: node.depth + 1})
+		} else if f.Type == "file" && f.Name == req.Repo.Config {
+			node.children = append(node.children, &treeNode{path: f.Path})
+		}
+	}
+	w.push(node.children...)
+}